@@ -5,32 +5,84 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
+	"path"
 	"regexp"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/google/subcommands"
 
+	"github.com/alyssadaemon/troll/pkg/cgroup"
 	"github.com/alyssadaemon/troll/pkg/cpu"
+	"github.com/alyssadaemon/troll/pkg/dns"
 	"github.com/alyssadaemon/troll/pkg/files"
 	"github.com/alyssadaemon/troll/pkg/mem"
 	"github.com/alyssadaemon/troll/pkg/network"
+	"github.com/alyssadaemon/troll/pkg/units"
 )
 
-var httpRegex = regexp.MustCompile("^https?://")
+var httpRegex = regexp.MustCompile("^(https?|wss?)://")
 
 type FilesCommand struct {
 	rootPath        string
-	maxSize         int64
+	maxSize         string
 	singleFile      bool
 	randomBytes     bool
 	fillFile        bool
 	maxWorkers      int64
 	replicationRate int64
+	mode            string
+	pattern         string
+	blockSize       string
+	ioDepth         int64
+	fileCount       int64
+	readPercent     int64
+	durability      string
+	syncEvery       string
+	verify          string
+	deleteOnExit    bool
+	keepFiles       int64
+	maxBytes        string
+	maxDiskUsage    float64
+	treeDepth       int64
+	treeWidth       int64
+	opsPerSecond    int64
+	metadataOps     string
+	targetPercent   float64
+	targetFree      string
+	holdTime        int64
+	oscillation     string
+	useWrites       bool
+	inodeFileSize   string
+	data            string
+	compressRatio   float64
+	dedupPercent    float64
+	writers         int64
+	pwrite          bool
+	bytesPerSecond  string
+	iops            int64
+	linesPerSecond  int64
+	minLineSize     string
+	maxLineSize     string
+	rotateSize      string
+	rotateEvery     int64
+	compressLogs    bool
+	cache           string
+	sizes           string
+	minFileSize     string
+	meanFileSize    string
+	fileSizeStdDev  string
+	paretoShape     float64
+	histogram       string
+	stallThreshold  int64
 }
 
 func (*FilesCommand) Name() string {
@@ -52,55 +104,524 @@ func (f *FilesCommand) Usage() string {
 
 func (f *FilesCommand) SetFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&f.singleFile, "single", false, "Write to a single files instead of multiple")
-	flags.BoolVar(&f.randomBytes, "bytes", true, "Write random bytes (instead of the same bytes over and over")
-	flags.BoolVar(&f.fillFile, "fill", false, "Turns on infinitely filling a single file (only works in singleFile mode)")
+	flags.BoolVar(&f.randomBytes, "bytes", true, "Write freshly generated bytes (instead of the same bytes over and over")
+	flags.StringVar(&f.data, "data", "", "What data to write (random, zero, text, compressible), defaults to zero in -fill mode with -bytes=false and random otherwise")
+	flags.Float64Var(&f.compressRatio, "compress", 2, "With -data compressible, the target compression ratio (2 is 2:1)")
+	flags.Float64Var(&f.dedupPercent, "dedup", 0, "Percentage of 4KiB blocks that duplicate earlier blocks")
+	flags.BoolVar(&f.fillFile, "fill", false, "Turns on infinitely filling files, the -path file with -single or -nrfiles files under -path otherwise")
+	flags.Int64Var(&f.writers, "writers", 1, "With -fill, how many goroutines write concurrently")
+	flags.BoolVar(&f.pwrite, "pwrite", false, "With -fill, write at disjoint offsets with pwrite instead of appending")
 	flags.StringVar(&f.rootPath, "path", "/tmp", "Where should we be writing files to?")
-	flags.Int64Var(&f.maxSize, "size", 512, "How big should files be?")
+	flags.StringVar(&f.maxSize, "size", "512", "How big should files be? Supports b,k,m,g,t,p")
 	flags.Int64Var(&f.maxWorkers, "workers", 1, "In multifile, how many files to write per tick")
 	flags.Int64Var(&f.replicationRate, "rate", 1000, "How long a 'tick' is in ms")
+	flags.StringVar(&f.mode, "mode", "write", "What kind of load to generate (write, io, metadata, diskfull, inodes, log, mmap)")
+	flags.StringVar(&f.pattern, "pattern", files.PatternRandRW, "In io and mmap modes, the access pattern (read, write, randread, randwrite, readwrite, randrw)")
+	flags.StringVar(&f.blockSize, "bs", "4k", "In io mode, how big each read or write is. Supports b,k,m,g,t,p")
+	flags.Int64Var(&f.ioDepth, "iodepth", 1, "In io mode, how many I/Os to keep outstanding")
+	flags.Int64Var(&f.fileCount, "nrfiles", 1, "In io and -fill modes, how many files to spread I/O across")
+	flags.Int64Var(&f.readPercent, "rwmix", 50, "In io and mmap modes, percentage of reads for the readwrite and randrw patterns")
+	flags.StringVar(&f.durability, "durability", "", "How writes reach the disk (none, fsync, fdatasync, direct, osync, odsync), defaults to fsync in -fill mode with -bytes and none otherwise")
+	flags.StringVar(&f.sizes, "sizes", "", "In multifile and log modes, how file sizes up to -size and line sizes up to -line-max are picked (fixed, uniform, normal, lognormal, pareto, empirical), defaults to uniform, or fixed in multifile with -bytes=false")
+	flags.StringVar(&f.minFileSize, "size-min", "0", "In multifile, the smallest file to write, also the Pareto scale. Supports b,k,m,g,t,p")
+	flags.StringVar(&f.meanFileSize, "size-mean", "0", "For normal and lognormal sizes, the mean size, 0 is halfway between the smallest and largest. Supports b,k,m,g,t,p")
+	flags.StringVar(&f.fileSizeStdDev, "size-stddev", "0", "For normal and lognormal sizes, the standard deviation, 0 is a sixth of the range. Supports b,k,m,g,t,p")
+	flags.Float64Var(&f.paretoShape, "pareto-shape", 1.16, "For pareto sizes, the tail index, lower is more skewed")
+	flags.StringVar(&f.histogram, "size-histogram", "", "For empirical sizes, a file of \"size weight\" lines, one per histogram bucket")
+	flags.Int64Var(&f.stallThreshold, "stall", 1000, "In multifile and -fill modes, flag any operation taking at least this many ms as a stall, 0 disables")
+	flags.StringVar(&f.cache, "cache", files.CacheDefault, "Page cache policy for written data (default, keep to read it back over and over, drop to evict it)")
+	flags.StringVar(&f.verify, "verify", files.VerifyNone, "In multifile, read files back and check their CRC32C (none, concurrent, after)")
+	flags.Int64Var(&f.treeDepth, "depth", 3, "In metadata mode, how deep the directory tree is")
+	flags.Int64Var(&f.treeWidth, "width", 4, "In metadata mode, how many directories each directory holds")
+	flags.Int64Var(&f.opsPerSecond, "ops", 0, "In metadata mode, target operations per second (overrides -rate), 0 uses -rate")
+	flags.StringVar(&f.metadataOps, "metadata-ops", strings.Join(files.MetadataOps, ","), "In metadata mode, comma seperated operations to mix")
+	flags.Float64Var(&f.targetPercent, "target", 90, "In diskfull and inodes modes, the percentage of the filesystem (or its inodes) to fill")
+	flags.StringVar(&f.targetFree, "target-free", "0", "In diskfull mode, fill until only this many bytes are free instead of -target. Supports b,k,m,g,t,p")
+	flags.Int64Var(&f.holdTime, "hold", 0, "In diskfull and inodes modes, how long to hold the target in ms before releasing, 0 holds until exit")
+	flags.StringVar(&f.inodeFileSize, "inode-size", "0", "In inodes mode, how many bytes to write to each file. Supports b,k,m,g,t,p")
+	flags.StringVar(&f.oscillation, "oscillate", "0", "In diskfull mode, free this many bytes every other tick while holding. Supports b,k,m,g,t,p")
+	flags.BoolVar(&f.useWrites, "writes", false, "In diskfull mode, fill with writes instead of fallocate")
+	flags.StringVar(&f.bytesPerSecond, "bps", "0", "Cap write throughput (reads and writes in io mode) at this many bytes per second, 0 disables. Supports b,k,m,g,t,p")
+	flags.Int64Var(&f.iops, "iops", 0, "Cap writes (files in multifile, blocks with -fill, every I/O in io mode) per second, 0 disables")
+	flags.Int64Var(&f.linesPerSecond, "lines", 100, "In log mode, how many lines to log per second")
+	flags.StringVar(&f.minLineSize, "line-min", "80", "In log mode, the shortest line to log. Supports b,k,m,g,t,p")
+	flags.StringVar(&f.maxLineSize, "line-max", "200", "In log mode, the longest line to log. Supports b,k,m,g,t,p")
+	flags.StringVar(&f.rotateSize, "rotate-size", "10m", "In log mode, rotate the log once it is this big, 0 disables. Supports b,k,m,g,t,p")
+	flags.Int64Var(&f.rotateEvery, "rotate-every", 0, "In log mode, rotate the log once it is this many ms old, 0 disables")
+	flags.BoolVar(&f.compressLogs, "gzip", false, "In log mode, gzip rotated logs")
+	flags.BoolVar(&f.deleteOnExit, "delete", false, "Delete the files written when exiting")
+	flags.Int64Var(&f.keepFiles, "keep", 0, "In multifile and log modes, only keep the newest N files, 0 keeps everything")
+	flags.StringVar(&f.maxBytes, "max-bytes", "0", "Delete the oldest files (or start a -fill file over) to keep under this many bytes, 0 disables. Supports b,k,m,g,t,p")
+	flags.Float64Var(&f.maxDiskUsage, "max-disk", 0, "Stop writing once the filesystem is this percent full, 0 disables")
+	flags.StringVar(&f.syncEvery, "sync-every", "0", "Sync every time this many bytes are written to a file, 0 syncs when a file is finished. Supports b,k,m,g,t,p")
 }
 
 func (f *FilesCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	maxSize, err := units.ParseSize(f.maxSize)
 
-	if f.singleFile {
+	if err != nil {
+		fmt.Printf("Error parsing size %v\n", err)
+		return subcommands.ExitFailure
+	}
 
-		if f.fillFile {
-
-			if f.randomBytes {
-				err := files.NeverEndingRandomFile(f.rootPath, f.maxSize)
-				if err != nil {
-					fmt.Println(err)
-					return subcommands.ExitFailure
-				}
-			} else {
-				err := files.NeverEndingFile(f.rootPath, f.maxSize)
-				if err != nil {
-					fmt.Println(err)
-					return subcommands.ExitFailure
-				}
-			}
+	options, err := f.options()
 
-		} else {
-			_, err := files.CreateAndWriteFile(f.rootPath, f.maxSize)
-			if err != nil {
-				fmt.Println(err)
-				return subcommands.ExitFailure
-			}
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	if !files.ValidVerify(f.verify) {
+		fmt.Printf("Unknown verify mode %v\n", f.verify)
+		return subcommands.ExitFailure
+	}
+
+	switch f.mode {
+	case "write":
+		return f.write(ctx, maxSize, options)
+	case "io":
+		return f.io(ctx, maxSize, options)
+	case "metadata":
+		return f.metadata(ctx, options)
+	case "diskfull":
+		return f.diskFull(ctx)
+	case "inodes":
+		return f.inodes(ctx)
+	case "log":
+		return f.log(ctx, options)
+	case "mmap":
+		return f.mmap(ctx, maxSize, options)
+	}
+
+	fmt.Printf("Unknown mode %v\n", f.mode)
+	return subcommands.ExitFailure
+}
+
+func (f *FilesCommand) fill(ctx context.Context, size int64, options files.Options) subcommands.ExitStatus {
+	paths := []string{f.rootPath}
+
+	if !f.singleFile {
+		paths = nil
+
+		for i := int64(0); i < f.fileCount; i++ {
+			paths = append(paths, path.Join(f.rootPath, fmt.Sprintf("troll-fill-%v", i)))
+		}
+	}
+
+	filler := files.Filler{
+		Context: ctx,
+		Ticker:  time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
+		Paths:   paths,
+		Size:    size,
+		Writers: f.writers,
+		Pwrite:  f.pwrite,
+		Random:  f.randomBytes,
+		Options: options,
+		Stalls:  files.StallDetector{Threshold: time.Duration(f.stallThreshold) * time.Millisecond},
+	}
+
+	err := filler.Run()
+
+	// Without a start time the files were never opened, there is nothing to report
+	if !filler.StartTime.IsZero() {
+		filler.Stats()
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+func (f *FilesCommand) io(ctx context.Context, fileSize int64, options files.Options) subcommands.ExitStatus {
+	if !files.ValidPattern(f.pattern) {
+		fmt.Printf("Unknown pattern %v\n", f.pattern)
+		return subcommands.ExitFailure
+	}
+
+	if options.Cache == files.CacheKeep {
+		fmt.Println("-cache keep doesn't apply to io mode, its files are read over and over already")
+		return subcommands.ExitFailure
+	}
+
+	blockSize, err := units.ParseSize(f.blockSize)
+
+	if err != nil {
+		fmt.Printf("Error parsing block size %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	replicator := files.IOReplicator{
+		Context:     ctx,
+		Ticker:      time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
+		RootPath:    f.rootPath,
+		Files:       f.fileCount,
+		FileSize:    fileSize,
+		BlockSize:   blockSize,
+		QueueDepth:  f.ioDepth,
+		Pattern:     f.pattern,
+		ReadPercent: f.readPercent,
+		Options:     options,
+	}
+
+	if err := replicator.Run(); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	replicator.Stats()
+
+	return subcommands.ExitSuccess
+}
 
+func (f *FilesCommand) metadata(ctx context.Context, options files.Options) subcommands.ExitStatus {
+	ops := strings.Split(f.metadataOps, ",")
+
+	for _, op := range ops {
+		if !files.ValidMetadataOp(op) {
+			fmt.Printf("Unknown metadata operation %v\n", op)
+			return subcommands.ExitFailure
 		}
+	}
+
+	tick := time.Duration(f.replicationRate) * time.Millisecond
+
+	if f.opsPerSecond > 0 {
+		// Each tick tops the workers back up, so spread the target over them
+		tick = time.Duration(int64(time.Second) * f.maxWorkers / f.opsPerSecond)
+
+		if tick <= 0 {
+			tick = time.Microsecond
+		}
+	}
+
+	replicator := files.MetadataReplicator{
+		Context:    ctx,
+		Ticker:     time.NewTicker(tick),
+		RootPath:   f.rootPath,
+		MaxWorkers: f.maxWorkers,
+		Depth:      f.treeDepth,
+		Width:      f.treeWidth,
+		Operations: ops,
+		Options:    options,
+	}
+
+	err := replicator.Run()
+	replicator.Cleanup()
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	replicator.Stats()
+
+	return subcommands.ExitSuccess
+}
+
+func (f *FilesCommand) diskFull(ctx context.Context) subcommands.ExitStatus {
+	targetFree, err := units.ParseSize(f.targetFree)
+
+	if err != nil {
+		fmt.Printf("Error parsing target-free %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	oscillation, err := units.ParseSize(f.oscillation)
+
+	if err != nil {
+		fmt.Printf("Error parsing oscillate %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	pressure := files.DiskPressure{
+		Context:       ctx,
+		Ticker:        time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
+		RootPath:      f.rootPath,
+		TargetPercent: f.targetPercent,
+		TargetFree:    targetFree,
+		HoldTime:      time.Duration(f.holdTime) * time.Millisecond,
+		Oscillation:   oscillation,
+		UseWrites:     f.useWrites,
+	}
+
+	if err := pressure.Run(); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	pressure.Stats()
+
+	return subcommands.ExitSuccess
+}
+
+func (f *FilesCommand) inodes(ctx context.Context) subcommands.ExitStatus {
+	fileSize, err := units.ParseSize(f.inodeFileSize)
+
+	if err != nil {
+		fmt.Printf("Error parsing inode-size %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	pressure := files.InodePressure{
+		Context:       ctx,
+		Ticker:        time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
+		RootPath:      f.rootPath,
+		TargetPercent: f.targetPercent,
+		HoldTime:      time.Duration(f.holdTime) * time.Millisecond,
+		FileSize:      fileSize,
+	}
+
+	if err := pressure.Run(); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	pressure.Stats()
+
+	return subcommands.ExitSuccess
+}
+
+func (f *FilesCommand) log(ctx context.Context, options files.Options) subcommands.ExitStatus {
+	sizes := map[string]int64{}
+
+	for name, value := range map[string]string{"line-min": f.minLineSize, "line-max": f.maxLineSize, "rotate-size": f.rotateSize} {
+		size, err := units.ParseSize(value)
+
+		if err != nil {
+			fmt.Printf("Error parsing %v %v\n", name, err)
+			return subcommands.ExitFailure
+		}
+
+		sizes[name] = size
+	}
+
+	lineSizes, err := f.sizeDistribution(sizes["line-min"], sizes["line-max"])
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	writer := files.LogWriter{
+		Context:        ctx,
+		Ticker:         time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
+		RootPath:       f.rootPath,
+		LinesPerSecond: f.linesPerSecond,
+		LineSizes:      lineSizes,
+		RotateSize:     sizes["rotate-size"],
+		RotateEvery:    time.Duration(f.rotateEvery) * time.Millisecond,
+		Compress:       f.compressLogs,
+		Keep:           f.keepFiles,
+		Options:        options,
+	}
+
+	err = writer.Run()
+	writer.Stats()
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+func (f *FilesCommand) mmap(ctx context.Context, size int64, options files.Options) subcommands.ExitStatus {
+	if !files.ValidPattern(f.pattern) {
+		fmt.Printf("Unknown pattern %v\n", f.pattern)
+		return subcommands.ExitFailure
+	}
+
+	replicator := files.MmapReplicator{
+		Context:     ctx,
+		Ticker:      time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
+		Path:        path.Join(f.rootPath, "troll-mmap"),
+		Size:        size,
+		Pattern:     f.pattern,
+		ReadPercent: f.readPercent,
+		Options:     options,
+	}
+
+	err := replicator.Run()
+	replicator.Stats()
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// sizeDistribution builds the -sizes distribution for sizes from minSize up to maxSize
+func (f *FilesCommand) sizeDistribution(minSize, maxSize int64) (files.SizeDistribution, error) {
+	sizes := files.SizeDistribution{Kind: f.sizes, Min: minSize, Max: maxSize, Shape: f.paretoShape}
+
+	if f.sizes == "" {
+		// Run picks the historical default
+		return sizes, nil
+	}
+
+	values := map[string]int64{}
+
+	for name, value := range map[string]string{"size-mean": f.meanFileSize, "size-stddev": f.fileSizeStdDev} {
+		size, err := units.ParseSize(value)
+
+		if err != nil {
+			return sizes, fmt.Errorf("Error parsing %v %v", name, err)
+		}
+
+		values[name] = size
+	}
+
+	sizes.Mean = float64(values["size-mean"])
+	sizes.StdDev = float64(values["size-stddev"])
+
+	if f.sizes == files.SizeEmpirical {
+		histogram, err := files.ReadHistogram(f.histogram)
+
+		if err != nil {
+			return sizes, err
+		}
+
+		sizes.Histogram = histogram
+	}
+
+	return sizes, sizes.Init()
+}
+
+func (f *FilesCommand) options() (files.Options, error) {
+	if f.durability == "" {
+		// Filling a file with fresh bytes has always synced after every write
+		f.durability = files.DurabilityNone
+
+		if f.fillFile && f.randomBytes {
+			f.durability = files.DurabilityFsync
+		}
+	}
+
+	options := files.Options{Durability: f.durability, Cache: f.cache}
+
+	if !files.ValidDurability(f.durability) {
+		return options, fmt.Errorf("Unknown durability %v", f.durability)
+	}
+
+	if !files.ValidCache(f.cache) {
+		return options, fmt.Errorf("Unknown cache policy %v", f.cache)
+	}
+
+	syncEvery, err := units.ParseSize(f.syncEvery)
+
+	if err != nil {
+		return options, fmt.Errorf("Error parsing sync-every %v", err)
+	}
+
+	options.SyncEvery = syncEvery
+
+	maxBytes, err := units.ParseSize(f.maxBytes)
+
+	if err != nil {
+		return options, fmt.Errorf("Error parsing max-bytes %v", err)
+	}
+
+	options.Retention = files.Retention{
+		DeleteOnExit: f.deleteOnExit,
+		KeepFiles:    f.keepFiles,
+		MaxBytes:     maxBytes,
+		MaxDiskUsage: f.maxDiskUsage,
+	}
+
+	if f.data == "" {
+		// Filling with the same bytes over and over has always written zeros
+		f.data = files.DataRandom
+
+		if f.fillFile && !f.randomBytes {
+			f.data = files.DataZero
+		}
+	}
+
+	if !files.ValidData(f.data) {
+		return options, fmt.Errorf("Unknown data generator %v", f.data)
+	}
+
+	if f.compressRatio < 1 {
+		return options, fmt.Errorf("Compression ratio %v must be at least 1", f.compressRatio)
+	}
+
+	if f.dedupPercent < 0 || f.dedupPercent > 100 {
+		return options, fmt.Errorf("Dedup percentage %v must be between 0 and 100", f.dedupPercent)
+	}
+
+	bytesPerSecond, err := units.ParseSize(f.bytesPerSecond)
+
+	if err != nil {
+		return options, fmt.Errorf("Error parsing bps %v", err)
+	}
+
+	options.Limiter = files.NewLimiter(bytesPerSecond, f.iops)
+
+	options.Data = files.Generator{
+		Kind:          f.data,
+		CompressRatio: f.compressRatio,
+		DedupPercent:  f.dedupPercent,
+	}
 
+	return options, nil
+}
+
+func (f *FilesCommand) write(ctx context.Context, maxSize int64, options files.Options) subcommands.ExitStatus {
+	if f.fillFile {
+		return f.fill(ctx, maxSize, options)
+	}
+
+	if f.singleFile {
+		_, err := files.CreateAndWriteFile(f.rootPath, maxSize, options)
+		options.Retention.Cleanup(f.rootPath)
+
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
 	} else {
+		minSize, err := units.ParseSize(f.minFileSize)
+
+		if err != nil {
+			fmt.Printf("Error parsing size-min %v\n", err)
+			return subcommands.ExitFailure
+		}
+
+		sizes, err := f.sizeDistribution(minSize, maxSize)
+
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+
 		replicator := files.Replicator{
 			RootPath:     f.rootPath,
 			Ticker:       time.NewTicker(time.Duration(f.replicationRate) * time.Millisecond),
-			MaxSize:      f.maxSize,
+			MaxSize:      maxSize,
 			MaxWorkers:   f.maxWorkers,
 			Context:      ctx,
 			RandomBytes:  f.randomBytes,
 			ShortestTime: time.Duration(9223372036854775807),
+			Options:      options,
+			Verify:       f.verify,
+			Sizes:        sizes,
+			Stalls:       files.StallDetector{Threshold: time.Duration(f.stallThreshold) * time.Millisecond},
 		}
 
 		replicator.Run()
+
+		if f.verify == files.VerifyAfter {
+			replicator.VerifyAll()
+		}
+
+		replicator.Cleanup()
+
 		replicator.Stats()
 	}
 
@@ -112,6 +633,18 @@ type NetworkCommand struct {
 	replicationRate int64
 	maxWorkers      int64
 	workerSleep     int64
+	proxy           string
+	resolve         string
+	dnsServer       string
+	host            string
+	serverName      string
+	mode            string
+	messageRate     int64
+	payload         string
+	streamFormat    string
+	churn           bool
+	resumeTLS       bool
+	holdTime        int64
 }
 
 func (*NetworkCommand) Name() string {
@@ -136,6 +669,18 @@ func (n *NetworkCommand) SetFlags(flags *flag.FlagSet) {
 	flags.Int64Var(&n.replicationRate, "rate", 1000, "How long a 'tick' is in ms")
 	flags.Int64Var(&n.maxWorkers, "workers", 1, "How many concurrent workers to keep alive")
 	flags.Int64Var(&n.workerSleep, "sleep", 0, "Max number of milliseconds for worker to wait between calls, 0 deactiveates feature (0 is default)")
+	flags.StringVar(&n.proxy, "proxy", "", "Proxy to send requests through (http://, https:// or socks5://), defaults to the environment")
+	flags.StringVar(&n.resolve, "resolve", "", "Comma seperated host:port:ip overrides for name resolution")
+	flags.StringVar(&n.dnsServer, "dns", "", "DNS server (host:port) to resolve names with instead of the system resolver")
+	flags.StringVar(&n.host, "host", "", "Override the Host header sent with each request")
+	flags.StringVar(&n.serverName, "sni", "", "Override the server name sent during the TLS handshake")
+	flags.StringVar(&n.mode, "mode", network.ModeHTTP, "How to load the URLs (http, websocket, stream, idle)")
+	flags.BoolVar(&n.churn, "churn", false, "Open a new connection for every request instead of reusing them")
+	flags.BoolVar(&n.resumeTLS, "resume-tls", false, "Resume TLS sessions on new connections instead of doing a full handshake each time")
+	flags.Int64Var(&n.holdTime, "hold", 0, "In idle mode, how long to hold each connection open in ms before reopening it, 0 holds until exit")
+	flags.StringVar(&n.streamFormat, "stream", network.StreamSSE, "How to split a streamed response into events (sse, lines)")
+	flags.Int64Var(&n.messageRate, "message-rate", 1000, "How often each websocket connection sends a message in ms")
+	flags.StringVar(&n.payload, "payload", "{\"id\":\"{{.ID}}\",\"seq\":{{.Seq}}}", "Websocket message template, {{.ID}} is used to match replies (fields: ID, Seq, Time)")
 }
 
 func (n *NetworkCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -181,14 +726,218 @@ func (n *NetworkCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...
 		return subcommands.ExitFailure
 	}
 
+	routing, err := n.routing()
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	switch n.mode {
+	case network.ModeHTTP, network.ModeWebSocket, network.ModeStream, network.ModeIdle:
+	default:
+		fmt.Printf("Unknown mode %v\n", n.mode)
+		return subcommands.ExitFailure
+	}
+
+	switch n.streamFormat {
+	case network.StreamSSE, network.StreamLines:
+	default:
+		fmt.Printf("Unknown stream format %v\n", n.streamFormat)
+		return subcommands.ExitFailure
+	}
+
+	payload, err := template.New("payload").Parse(n.payload)
+
+	if err != nil {
+		fmt.Printf("Error parsing payload template %v\n", err)
+		return subcommands.ExitFailure
+	}
+
 	replicator := network.Replicator{
-		Context:      ctx,
-		Ticker:       time.NewTicker(time.Duration(n.replicationRate) * time.Millisecond),
-		MaxWorkers:   n.maxWorkers,
-		WorkerSleep:  n.workerSleep,
-		StatusStats:  make(map[int]int64),
-		URLs:         urls,
-		ShortestTime: time.Duration(9223372036854775807),
+		Context:         ctx,
+		Ticker:          time.NewTicker(time.Duration(n.replicationRate) * time.Millisecond),
+		MaxWorkers:      n.maxWorkers,
+		WorkerSleep:     n.workerSleep,
+		StatusStats:     make(map[int]int64),
+		URLs:            urls,
+		ShortestTime:    time.Duration(9223372036854775807),
+		Routing:         routing,
+		Mode:            n.mode,
+		MessageInterval: time.Duration(n.messageRate) * time.Millisecond,
+		Payload:         payload,
+		StreamFormat:    n.streamFormat,
+		Churn:           n.churn,
+		ResumeTLS:       n.resumeTLS,
+		HoldTime:        time.Duration(n.holdTime) * time.Millisecond,
+	}
+
+	replicator.Run()
+	replicator.Stats()
+
+	return subcommands.ExitSuccess
+}
+
+func (n *NetworkCommand) routing() (*network.Routing, error) {
+	routing := &network.Routing{
+		DNSServer:  n.dnsServer,
+		Host:       n.host,
+		ServerName: n.serverName,
+	}
+
+	if n.proxy != "" {
+		proxy, err := network.ParseProxy(n.proxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		routing.Proxy = proxy
+	}
+
+	resolve, err := network.ParseResolve(n.resolve)
+
+	if err != nil {
+		return nil, err
+	}
+
+	routing.Resolve = resolve
+
+	if routing.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(routing.DNSServer); err != nil {
+			routing.DNSServer = net.JoinHostPort(routing.DNSServer, "53")
+		}
+	}
+
+	return routing, nil
+}
+
+type DNSCommand struct {
+	nameFile        string
+	replicationRate int64
+	maxWorkers      int64
+	server          string
+	tcp             bool
+	types           string
+	timeout         int64
+	stub            bool
+}
+
+func (*DNSCommand) Name() string {
+	return "dns"
+}
+
+func (*DNSCommand) Synopsis() string {
+	return "Load Test DNS"
+}
+
+func (d *DNSCommand) Usage() string {
+	usage := strings.Builder{}
+
+	usage.WriteString(fmt.Sprintf("%s [args] <names>:\n", d.Name()))
+	usage.WriteString(fmt.Sprintf("\t%s\n", d.Synopsis()))
+
+	return usage.String()
+}
+
+func (d *DNSCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&d.nameFile, "file", "", "File location to pull names from")
+	flags.Int64Var(&d.replicationRate, "rate", 1000, "How long a 'tick' is in ms")
+	flags.Int64Var(&d.maxWorkers, "workers", 1, "How many queries to have in flight per tick")
+	flags.StringVar(&d.server, "server", "", "DNS server (host:port) to query instead of the system resolver")
+	flags.BoolVar(&d.tcp, "tcp", false, "Query over TCP instead of UDP")
+	flags.StringVar(&d.types, "types", "A", "Comma seperated record types to query for each name (A, AAAA, SRV, TXT)")
+	flags.Int64Var(&d.timeout, "timeout", 5000, "How long to wait for an answer in ms")
+	flags.BoolVar(&d.stub, "stub", false, "Query an in-process DNS stub instead of -server. Names starting with nxdomain., servfail., refused. or timeout. fail that way, anything else resolves")
+}
+
+func (d *DNSCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	args := flags.Args()
+	names := []string{}
+
+	if len(args) > 0 {
+		names = strings.Split(strings.Join(args, ","), ",")
+	}
+
+	if d.nameFile != "" {
+		output, err := ioutil.ReadFile(d.nameFile)
+
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+
+		names = strings.Split(string(output), "\n")
+	}
+
+	types := []string{}
+
+	for _, recordType := range strings.Split(d.types, ",") {
+		parsed, err := dns.ParseType(recordType)
+
+		if err != nil {
+			fmt.Println(err)
+			return subcommands.ExitFailure
+		}
+
+		types = append(types, parsed)
+	}
+
+	queries := make([]dns.Query, 0)
+
+	for _, name := range names {
+		trimmedName := strings.TrimSpace(name)
+
+		if len(trimmedName) == 0 || []rune(trimmedName)[0] == '#' {
+			continue
+		}
+
+		for _, recordType := range types {
+			queries = append(queries, dns.Query{Name: trimmedName, Type: recordType})
+		}
+	}
+
+	if len(queries) == 0 {
+		fmt.Println(fmt.Errorf("Empty names list, unable to continue %v", names))
+		return subcommands.ExitFailure
+	}
+
+	server := d.server
+
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+	}
+
+	network := "udp"
+
+	if d.tcp {
+		network = "tcp"
+	}
+
+	if d.stub {
+		stub, err := dns.StartStub()
+
+		if err != nil {
+			fmt.Printf("Unable to start the DNS stub: %v\n", err)
+			return subcommands.ExitFailure
+		}
+
+		defer stub.Close()
+		server = stub.Addr
+		fmt.Printf("DNS stub listening on %v\n", server)
+	}
+
+	replicator := dns.Replicator{
+		Context:    ctx,
+		Ticker:     time.NewTicker(time.Duration(d.replicationRate) * time.Millisecond),
+		MaxWorkers: d.maxWorkers,
+		Queries:    queries,
+		Server:     server,
+		Network:    network,
+		Timeout:    time.Duration(d.timeout) * time.Millisecond,
+		TypeStats:  make(map[string]int64),
 	}
 
 	replicator.Run()
@@ -251,6 +1000,18 @@ type MemoryCommand struct {
 	read            bool
 	release         bool
 	force           bool
+	profile         string
+	start           string
+	period          int64
+	step            string
+	stepEvery       int64
+	mode            string
+	objectSize      string
+	pointers        int
+	lifetime        int64
+	allocRate       string
+	gogc            string
+	memoryLimit     string
 }
 
 func (*MemoryCommand) Name() string {
@@ -270,26 +1031,102 @@ func (m *MemoryCommand) Usage() string {
 
 func (m *MemoryCommand) SetFlags(flags *flag.FlagSet) {
 	flags.Int64Var(&m.replicationRate, "rate", 1000, "How long a 'tick' is in ms")
-	flags.StringVar(&m.maxMem, "max", "1G", "Max amount in memory in base 2. Supports b,k,m,g,t,p")
+	flags.StringVar(&m.maxMem, "max", "1G", "Max amount in memory in base 2. Supports b,k,m,g,t,p, or a percentage like 90% of the cgroup's memory limit (the host's memory when unlimited)")
 	flags.Int64Var(&m.maxWorkers, "workers", 1, "Max number of workers writing and ready memory")
 	flags.BoolVar(&m.read, "read", false, "Should we test reading memory?")
-	flags.BoolVar(&m.release, "release", false, "Should we release all our memory every tick?")
+	flags.BoolVar(&m.release, "release", false, "Should we release all our memory every tick? Each job allocates its own memory instead of holding -max")
 	flags.BoolVar(&m.force, "force", false, "Should we force a GC every call?")
+	flags.StringVar(&m.profile, "profile", mem.ProfileHold, "How much memory to hold over time: hold, ramp, step, sawtooth or leak. Every profile stays under -max")
+	flags.StringVar(&m.start, "start", "0", "Where the ramp, step, sawtooth and leak profiles start. Supports b,k,m,g,t,p or a percentage of the limit")
+	flags.Int64Var(&m.period, "period", 60000, "How long in ms a ramp, or each tooth of a sawtooth, takes to grow from -start to -max")
+	flags.StringVar(&m.step, "step", "64m", "How much the step profile adds every -step-every, and the leak profile adds every tick. Supports b,k,m,g,t,p or a percentage of the limit")
+	flags.Int64Var(&m.stepEvery, "step-every", 10000, "How often in ms the step profile adds -step")
+	flags.StringVar(&m.mode, "mode", mem.ModePressure, "What to test: pressure holds memory following -profile, bandwidth runs the STREAM copy, scale, add and triad kernels over -max split between -workers, latency chases pointers through working sets from 4k up to -max split between -workers (concurrent workers share the caches they measure), gc allocates small objects in pointer graphs to load the garbage collector")
+	flags.StringVar(&m.objectSize, "object-size", "64b", "In gc mode, how big each object is. Supports b,k,m,g,t,p")
+	flags.IntVar(&m.pointers, "pointers", 2, "In gc mode, how many other live objects each object points to")
+	flags.Int64Var(&m.lifetime, "lifetime", 1000, "In gc mode, how long in ms each object is kept alive, objects pointing at it can keep it reachable for up to twice as long. Live objects are also capped at -max")
+	flags.StringVar(&m.allocRate, "alloc-rate", "0", "In gc mode, the most bytes per second to allocate across all workers, 0 allocates as fast as possible. Supports b,k,m,g,t,p")
+	flags.StringVar(&m.gogc, "gogc", "", "Set GOGC for the run, a percentage or off. Empty leaves it alone")
+	flags.StringVar(&m.memoryLimit, "memory-limit", "", "Set the Go runtime's soft memory limit (GOMEMLIMIT) for the run. Supports b,k,m,g,t,p or a percentage of the cgroup's limit. Empty leaves it alone")
 }
 
 func (m *MemoryCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
-	maxSize, err := mem.ParseMemString(m.maxMem)
+	group, err := cgroup.Self()
+
+	if err != nil {
+		fmt.Printf("Unable to find the memory cgroup, not reporting on it: %v\n", err)
+	}
+
+	maxSize, err := mem.ParseLimitString(m.maxMem, group)
 
 	if err != nil {
 		fmt.Printf("Error parsing max memory %v\n", err)
 		return subcommands.ExitFailure
 	}
 
-	ram := make([]int, 0)
+	if maxSize <= 0 {
+		fmt.Println("-max must be more than 0 bytes")
+		return subcommands.ExitFailure
+	}
+
+	if m.maxWorkers <= 0 {
+		fmt.Println("-workers must be at least 1")
+		return subcommands.ExitFailure
+	}
+
+	start, err := mem.ParseLimitString(m.start, group)
 
-	if !m.release {
-		ram = make([]int, maxSize)
+	if err != nil {
+		fmt.Printf("Error parsing start %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	step, err := mem.ParseLimitString(m.step, group)
+
+	if err != nil {
+		fmt.Printf("Error parsing step %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	profile := mem.Profile{
+		Kind:      m.profile,
+		Start:     start,
+		Period:    time.Duration(m.period) * time.Millisecond,
+		Step:      step,
+		StepEvery: time.Duration(m.stepEvery) * time.Millisecond,
+	}
+
+	if err := profile.Check(maxSize); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	if m.release && profile.Kind != mem.ProfileHold {
+		fmt.Println("-release doesn't hold any memory, it can't follow a -profile")
+		return subcommands.ExitFailure
+	}
+
+	if !mem.ValidMode(m.mode) {
+		fmt.Printf("Unknown mode %v\n", m.mode)
+		return subcommands.ExitFailure
+	}
+
+	if m.mode != mem.ModePressure && (m.release || profile.Kind != mem.ProfileHold) {
+		fmt.Printf("-release and -profile only apply to pressure mode, not %v\n", m.mode)
+		return subcommands.ExitFailure
+	}
+
+	if (m.mode == mem.ModeBandwidth || m.mode == mem.ModeLatency) && maxSize/m.maxWorkers < mem.MinWorkingSet {
+		fmt.Printf("%v mode needs at least %v bytes per worker\n", m.mode, mem.MinWorkingSet)
+		return subcommands.ExitFailure
+	}
+
+	gcOptions, err := m.gcOptions(group)
+
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
 	}
 
 	replicator := mem.Replicator{
@@ -298,9 +1135,12 @@ func (m *MemoryCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...i
 		MaxWorkers:    m.maxWorkers,
 		Context:       ctx,
 		Force:         m.force,
-		RAM:           ram,
 		Read:          m.read,
 		ReleaseMemory: m.release,
+		Profile:       profile,
+		Cgroup:        group,
+		Mode:          m.mode,
+		GC:            gcOptions,
 		ShortestTime:  time.Duration(9223372036854775807),
 	}
 
@@ -311,6 +1151,59 @@ func (m *MemoryCommand) Execute(ctx context.Context, flags *flag.FlagSet, _ ...i
 
 }
 
+// gcOptions parses the gc mode's flags and applies -gogc and -memory-limit
+func (m *MemoryCommand) gcOptions(group *cgroup.Cgroup) (mem.GCOptions, error) {
+	options := mem.GCOptions{
+		Pointers: m.pointers,
+		Lifetime: time.Duration(m.lifetime) * time.Millisecond,
+	}
+
+	objectSize, err := units.ParseSize(m.objectSize)
+
+	if err != nil {
+		return options, fmt.Errorf("Error parsing object size %v", err)
+	}
+
+	allocRate, err := units.ParseSize(m.allocRate)
+
+	if err != nil {
+		return options, fmt.Errorf("Error parsing alloc rate %v", err)
+	}
+
+	if objectSize <= 0 || m.pointers < 0 || m.lifetime < 0 {
+		return options, fmt.Errorf("-object-size must be more than 0, -pointers and -lifetime can't be negative")
+	}
+
+	options.ObjectSize = objectSize
+	options.AllocRate = allocRate
+
+	switch m.gogc {
+	case "":
+	case "off":
+		debug.SetGCPercent(-1)
+	default:
+		percent, err := strconv.Atoi(m.gogc)
+
+		if err != nil || percent < 0 {
+			return options, fmt.Errorf("-gogc must be a percentage or off, not %v", m.gogc)
+		}
+
+		debug.SetGCPercent(percent)
+	}
+
+	if m.memoryLimit != "" {
+		limit, err := mem.ParseLimitString(m.memoryLimit, group)
+
+		if err != nil {
+			return options, fmt.Errorf("Error parsing memory limit %v", err)
+		}
+
+		debug.SetMemoryLimit(limit)
+	}
+
+	return options, nil
+}
+
 func main() {
 	done := make(chan os.Signal, 1)
 
@@ -321,6 +1214,7 @@ func main() {
 	subcommands.Register(subcommands.CommandsCommand(), "")
 	subcommands.Register(&FilesCommand{}, "")
 	subcommands.Register(&NetworkCommand{}, "")
+	subcommands.Register(&DNSCommand{}, "")
 	subcommands.Register(&CPUCommand{}, "")
 	subcommands.Register(&MemoryCommand{}, "")
 
@@ -0,0 +1,145 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Root is where cgroup filesystems are mounted
+const Root = "/sys/fs/cgroup"
+
+// Cgroup is the memory cgroup a process belongs to
+type Cgroup struct {
+	// Version is 1 for the legacy memory controller and 2 for the unified hierarchy
+	Version int
+	// Path is the cgroup's directory under Root
+	Path string
+}
+
+// PageCache is the page cache charged to a cgroup
+type PageCache struct {
+	Cache     int64
+	Dirty     int64
+	Writeback int64
+}
+
+// Self finds the memory cgroup of the current process from /proc/self/cgroup,
+// preferring the v1 memory controller on hybrid hosts
+func Self() (*Cgroup, error) {
+	file, err := os.Open("/proc/self/cgroup")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var unified *Cgroup
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+
+		if len(fields) != 3 {
+			continue
+		}
+
+		if fields[0] == "0" && fields[1] == "" {
+			unified = &Cgroup{Version: 2, Path: find(Root, fields[2])}
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				return &Cgroup{Version: 1, Path: find(path.Join(Root, "memory"), fields[2])}, nil
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if unified == nil {
+		return nil, fmt.Errorf("no memory cgroup found in /proc/self/cgroup")
+	}
+
+	return unified, nil
+}
+
+// find joins the cgroup path onto the mount, falling back to the mount itself
+// when a cgroup namespace hides the full path
+func find(mount, cgroup string) string {
+	full := path.Join(mount, cgroup)
+
+	if _, err := os.Stat(full); err == nil {
+		return full
+	}
+
+	return mount
+}
+
+// MemoryStat parses memory.stat into a map of counters
+func (c *Cgroup) MemoryStat() (map[string]int64, error) {
+	return c.readKeyed("memory.stat")
+}
+
+// readKeyed parses a file of "key value" lines into a map of counters
+func (c *Cgroup) readKeyed(name string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(path.Join(c.Path, name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]int64)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		stats[fields[0]] = value
+	}
+
+	return stats, nil
+}
+
+// PageCache reads the page cache charged to the cgroup out of memory.stat,
+// v1 counts it as cache (total_cache including children) and v2 as file
+func (c *Cgroup) PageCache() (PageCache, error) {
+	stats, err := c.MemoryStat()
+
+	if err != nil {
+		return PageCache{}, err
+	}
+
+	if c.Version == 2 {
+		return PageCache{Cache: stats["file"], Dirty: stats["file_dirty"], Writeback: stats["file_writeback"]}, nil
+	}
+
+	if _, ok := stats["total_cache"]; ok {
+		return PageCache{Cache: stats["total_cache"], Dirty: stats["total_dirty"], Writeback: stats["total_writeback"]}, nil
+	}
+
+	return PageCache{Cache: stats["cache"], Dirty: stats["dirty"], Writeback: stats["writeback"]}, nil
+}
+
+func (p PageCache) String() string {
+	return fmt.Sprintf("%v bytes cached, %v dirty, %v writeback", p.Cache, p.Dirty, p.Writeback)
+}
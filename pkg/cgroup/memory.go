@@ -0,0 +1,164 @@
+package cgroup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// unlimited is where v1 limits start meaning no limit, the kernel reports
+// the largest page aligned int64 rather than a marker like v2's "max"
+const unlimited = 1 << 62
+
+// Memory is how much memory a cgroup may use and is using
+type Memory struct {
+	// Limit is memory.max or memory.limit_in_bytes, 0 when unlimited
+	Limit int64
+	// Usage is memory.current or memory.usage_in_bytes
+	Usage int64
+	// Peak is the high watermark of Usage, memory.peak or
+	// memory.max_usage_in_bytes, 0 on kernels that don't track it
+	Peak int64
+}
+
+// Events counts the memory events of a cgroup. v1 has no memory.events, Max
+// comes from memory.failcnt and OOMKill from memory.oom_control there
+type Events struct {
+	// High is how often usage went over memory.high and was throttled
+	High int64
+	// Max is how often usage hit the limit and had to reclaim
+	Max int64
+	// OOM is how often the OOM killer was invoked
+	OOM int64
+	// OOMKill is how many processes the OOM killer killed
+	OOMKill int64
+}
+
+// Memory reads the cgroup's limit, usage and peak usage
+func (c *Cgroup) Memory() (Memory, error) {
+	memory := Memory{}
+	limitFile, usageFile, peakFile := "memory.max", "memory.current", "memory.peak"
+
+	if c.Version == 1 {
+		limitFile, usageFile, peakFile = "memory.limit_in_bytes", "memory.usage_in_bytes", "memory.max_usage_in_bytes"
+	}
+
+	limit, err := c.readInt(limitFile)
+
+	if err != nil {
+		return memory, err
+	}
+
+	if limit < unlimited {
+		memory.Limit = limit
+	}
+
+	memory.Usage, err = c.readInt(usageFile)
+
+	if err != nil {
+		return memory, err
+	}
+
+	memory.Peak, err = c.readInt(peakFile)
+
+	if err != nil && !os.IsNotExist(err) {
+		return memory, err
+	}
+
+	return memory, nil
+}
+
+// EffectiveLimit is the tightest memory limit of the cgroup and its ancestors,
+// 0 when none of them has one. A leaf without a limit is still bound by its
+// parents, like a container's cgroup under a pod's. The walk stops at the
+// first directory without a limit file, the hierarchy's root
+func (c *Cgroup) EffectiveLimit() (int64, error) {
+	limitFile := "memory.max"
+
+	if c.Version == 1 {
+		limitFile = "memory.limit_in_bytes"
+	}
+
+	limit := int64(0)
+
+	for dir := c.Path; ; dir = path.Dir(dir) {
+		value, err := (&Cgroup{Version: c.Version, Path: dir}).readInt(limitFile)
+
+		if os.IsNotExist(err) {
+			return limit, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		if value < unlimited && (limit == 0 || value < limit) {
+			limit = value
+		}
+
+		if dir == "/" || dir == "." {
+			return limit, nil
+		}
+	}
+}
+
+// Events reads the cgroup's memory events
+func (c *Cgroup) Events() (Events, error) {
+	if c.Version == 2 {
+		events, err := c.readKeyed("memory.events")
+
+		if err != nil {
+			return Events{}, err
+		}
+
+		return Events{High: events["high"], Max: events["max"], OOM: events["oom"], OOMKill: events["oom_kill"]}, nil
+	}
+
+	failures, err := c.readInt("memory.failcnt")
+
+	if err != nil {
+		return Events{}, err
+	}
+
+	control, err := c.readKeyed("memory.oom_control")
+
+	if err != nil {
+		return Events{}, err
+	}
+
+	return Events{Max: failures, OOMKill: control["oom_kill"]}, nil
+}
+
+// readInt reads a file holding a single number, "max" reads as unlimited
+func (c *Cgroup) readInt(name string) (int64, error) {
+	data, err := ioutil.ReadFile(path.Join(c.Path, name))
+
+	if err != nil {
+		return 0, err
+	}
+
+	value := strings.TrimSpace(string(data))
+
+	if value == "max" {
+		return unlimited, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (m Memory) String() string {
+	limit := "unlimited"
+
+	if m.Limit > 0 {
+		limit = fmt.Sprintf("%v bytes (%.1f%% used)", m.Limit, float64(m.Usage)*100/float64(m.Limit))
+	}
+
+	return fmt.Sprintf("%v bytes used, peak %v bytes, limit %v", m.Usage, m.Peak, limit)
+}
+
+func (e Events) String() string {
+	return fmt.Sprintf("high %v, max %v, oom %v, oom_kill %v", e.High, e.Max, e.OOM, e.OOMKill)
+}
@@ -0,0 +1,271 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+const (
+	TypeA    = "A"
+	TypeAAAA = "AAAA"
+	TypeSRV  = "SRV"
+	TypeTXT  = "TXT"
+)
+
+type Query struct {
+	Name string
+	Type string
+}
+
+type Response struct {
+	Query    Query
+	Answers  []string
+	Error    error
+	Duration time.Duration
+}
+
+type Replicator struct {
+	Context        context.Context
+	Ticker         *time.Ticker
+	MaxWorkers     int64
+	CurrentWorkers int64
+	Queries        []Query
+	// Server is the "host:port" to query, empty uses the system resolver
+	Server string
+	// Network is either udp or tcp
+	Network       string
+	Timeout       time.Duration
+	StartTime     time.Time
+	Successful    int64
+	NXDomain      int64
+	ServFail      int64
+	Timeouts      int64
+	OtherErrors   int64
+	AnswerChanges int64
+	// Latency covers every query, FailedLatency just the ones that failed
+	Latency       stats.Latency
+	FailedLatency stats.Latency
+	TypeStats     map[string]int64
+	lastAnswers   map[Query]string
+	resolver      *net.Resolver
+}
+
+// ParseType normalises a record type, returning an error for unsupported types
+func ParseType(recordType string) (string, error) {
+	upper := strings.ToUpper(strings.TrimSpace(recordType))
+
+	switch upper {
+	case TypeA, TypeAAAA, TypeSRV, TypeTXT:
+		return upper, nil
+	}
+
+	return "", fmt.Errorf("unsupported record type %v, expected A, AAAA, SRV or TXT", recordType)
+}
+
+func (r *Replicator) Stats() {
+	totalTime := time.Since(r.StartTime)
+	errors := r.NXDomain + r.ServFail + r.Timeouts + r.OtherErrors
+	totalQueries := r.Successful + errors
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration: %v\n", totalTime)
+	fmt.Printf("Max Concurrency: %v\n", r.MaxWorkers)
+	fmt.Printf("Total Queries: %v (%v successful, %v errors)\n", totalQueries, r.Successful, errors)
+
+	if totalTime.Seconds() > 0 {
+		fmt.Printf("Queries Per Second: %.2f\n", float64(totalQueries)/totalTime.Seconds())
+	}
+
+	fmt.Printf("Query Time: %v\n", &r.Latency)
+	fmt.Printf("Failed Query Time: %v\n", &r.FailedLatency)
+	fmt.Printf("NXDOMAIN (or no records): %v\n", r.NXDomain)
+	fmt.Printf("SERVFAIL (or other temporary failures): %v\n", r.ServFail)
+	fmt.Printf("Timeouts: %v\n", r.Timeouts)
+	fmt.Printf("Other Errors: %v\n", r.OtherErrors)
+	fmt.Printf("Answer Changes: %v\n", r.AnswerChanges)
+
+	if len(r.TypeStats) > 0 {
+		fmt.Println("Record Type Stats:")
+		for t, v := range r.TypeStats {
+			fmt.Printf("\t%v:\t%v\n", t, v)
+		}
+	}
+}
+
+func (r *Replicator) Run() {
+	r.StartTime = time.Now()
+	results := make(chan *Response, r.MaxWorkers)
+	r.lastAnswers = make(map[Query]string)
+
+	if r.TypeStats == nil {
+		r.TypeStats = make(map[string]int64)
+	}
+
+	r.resolver = r.newResolver()
+
+	for {
+		select {
+		case <-r.Context.Done():
+			return
+		case result := <-results:
+			r.record(result)
+			r.CurrentWorkers--
+		case <-r.Ticker.C:
+			if r.CurrentWorkers >= r.MaxWorkers {
+				continue
+			}
+			for r.MaxWorkers > r.CurrentWorkers {
+				go r.lookup(r.Queries[rand.Intn(len(r.Queries))], results)
+				r.CurrentWorkers++
+			}
+		}
+	}
+}
+
+func (r *Replicator) newResolver() *net.Resolver {
+	if r.Server == "" && r.Network != "tcp" {
+		return &net.Resolver{}
+	}
+
+	network := r.Network
+	server := r.Server
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, address string) (net.Conn, error) {
+			if server != "" {
+				address = server
+			}
+
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// record counts a response. The resolver doesn't hand back the rcode, so
+// errors are sorted by what net.DNSError reports: SERVFAIL is the only rcode
+// Go reports as temporary, but so are some local failures like EAI_AGAIN
+// from the system resolver, while REFUSED and the rest land in other errors
+func (r *Replicator) record(result *Response) {
+	r.TypeStats[result.Query.Type]++
+	r.Latency.Add(result.Duration)
+
+	if result.Error != nil {
+		fmt.Printf("%v %v: %v\n", result.Query.Type, result.Query.Name, result.Error)
+		r.FailedLatency.Add(result.Duration)
+
+		// Deadlines come back wrapped, in a net.DNSError or otherwise
+		var dnsErr *net.DNSError
+		var netErr net.Error
+
+		ok := errors.As(result.Error, &dnsErr)
+
+		switch {
+		case errors.Is(result.Error, context.DeadlineExceeded) || (errors.As(result.Error, &netErr) && netErr.Timeout()):
+			r.Timeouts++
+		case ok && dnsErr.IsNotFound:
+			r.NXDomain++
+		case ok && dnsErr.IsTemporary:
+			r.ServFail++
+		default:
+			r.OtherErrors++
+		}
+
+		return
+	}
+
+	r.Successful++
+
+	answers := strings.Join(result.Answers, " ")
+	fmt.Printf("%v %v: %v %v\n", result.Query.Type, result.Query.Name, answers, result.Duration)
+
+	if last, ok := r.lastAnswers[result.Query]; ok && last != answers {
+		fmt.Printf("Answer for %v %v changed from %v to %v\n", result.Query.Type, result.Query.Name, last, answers)
+		r.AnswerChanges++
+	}
+
+	r.lastAnswers[result.Query] = answers
+}
+
+func (r *Replicator) lookup(query Query, results chan<- *Response) {
+	ctx := r.Context
+
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	startTime := time.Now()
+	answers, err := r.resolve(ctx, query)
+	duration := time.Since(startTime)
+
+	sort.Strings(answers)
+
+	response := &Response{
+		Query:    query,
+		Answers:  answers,
+		Error:    err,
+		Duration: duration,
+	}
+
+	select {
+	case results <- response:
+	case <-r.Context.Done():
+	}
+}
+
+func (r *Replicator) resolve(ctx context.Context, query Query) ([]string, error) {
+	answers := make([]string, 0)
+
+	switch query.Type {
+	case TypeA, TypeAAAA:
+		network := "ip4"
+
+		if query.Type == TypeAAAA {
+			network = "ip6"
+		}
+
+		ips, err := r.resolver.LookupIP(ctx, network, query.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case TypeSRV:
+		_, records, err := r.resolver.LookupSRV(ctx, "", "", query.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			answers = append(answers, fmt.Sprintf("%v:%v/%v/%v", record.Target, record.Port, record.Priority, record.Weight))
+		}
+	case TypeTXT:
+		records, err := r.resolver.LookupTXT(ctx, query.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		answers = append(answers, records...)
+	default:
+		return nil, fmt.Errorf("unsupported record type %v", query.Type)
+	}
+
+	return answers, nil
+}
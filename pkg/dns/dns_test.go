@@ -0,0 +1,213 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestReplicator points a Replicator at stub without starting its Run loop
+func newTestReplicator(t *testing.T, stub *Stub, network string) *Replicator {
+	r := &Replicator{
+		Context:     context.Background(),
+		Server:      stub.Addr,
+		Network:     network,
+		Timeout:     250 * time.Millisecond,
+		TypeStats:   make(map[string]int64),
+		lastAnswers: make(map[Query]string),
+	}
+
+	r.resolver = r.newResolver()
+
+	return r
+}
+
+// query runs a single lookup through the Replicator and records it
+func query(r *Replicator, q Query) *Response {
+	results := make(chan *Response, 1)
+	r.lookup(q, results)
+	result := <-results
+	r.record(result)
+
+	return result
+}
+
+type counts struct {
+	Successful, NXDomain, ServFail, Timeouts, OtherErrors int64
+}
+
+func (r *Replicator) counts() counts {
+	return counts{r.Successful, r.NXDomain, r.ServFail, r.Timeouts, r.OtherErrors}
+}
+
+func TestRecordCounts(t *testing.T) {
+	stub, err := StartStub()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stub.Close()
+
+	stub.SetAnswers("empty.test", TypeA, nil)
+
+	tests := []struct {
+		query Query
+		want  counts
+	}{
+		{Query{"ok.test.", TypeA}, counts{Successful: 1}},
+		{Query{"ok.test.", TypeAAAA}, counts{Successful: 1}},
+		{Query{"ok.test.", TypeSRV}, counts{Successful: 1}},
+		{Query{"ok.test.", TypeTXT}, counts{Successful: 1}},
+		{Query{"nxdomain.test.", TypeA}, counts{NXDomain: 1}},
+		{Query{"empty.test.", TypeA}, counts{NXDomain: 1}},
+		{Query{"servfail.test.", TypeA}, counts{ServFail: 1}},
+		{Query{"refused.test.", TypeA}, counts{OtherErrors: 1}},
+		{Query{"timeout.test.", TypeA}, counts{Timeouts: 1}},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		for _, test := range tests {
+			t.Run(network+" "+test.query.Type+" "+test.query.Name, func(t *testing.T) {
+				r := newTestReplicator(t, stub, network)
+				result := query(r, test.query)
+
+				if got := r.counts(); got != test.want {
+					t.Errorf("counts = %+v, want %+v (error %v)", got, test.want, result.Error)
+				}
+
+				if r.Latency.Count() != 1 {
+					t.Errorf("latency has %v queries, want every query including failures", r.Latency.Count())
+				}
+
+				failed := int64(0)
+
+				if test.want.Successful == 0 {
+					failed = 1
+				}
+
+				if r.FailedLatency.Count() != failed {
+					t.Errorf("failed latency has %v queries, want %v", r.FailedLatency.Count(), failed)
+				}
+			})
+		}
+	}
+}
+
+func TestAnswers(t *testing.T) {
+	stub, err := StartStub()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stub.Close()
+
+	stub.SetAnswers("multi.test", TypeA, []string{"10.0.0.2", "10.0.0.1"})
+	stub.SetAnswers("multi.test", TypeAAAA, []string{"2001:db8::1"})
+	stub.SetAnswers("multi.test", TypeSRV, []string{"b.test.:8080/10/20"})
+	stub.SetAnswers("multi.test", TypeTXT, []string{"v=1", string(make([]byte, 300))})
+
+	tests := []struct {
+		query Query
+		want  []string
+	}{
+		{Query{"multi.test.", TypeA}, []string{"10.0.0.1", "10.0.0.2"}},
+		{Query{"multi.test.", TypeAAAA}, []string{"2001:db8::1"}},
+		{Query{"multi.test.", TypeSRV}, []string{"b.test.:8080/10/20"}},
+		{Query{"multi.test.", TypeTXT}, []string{string(make([]byte, 300)), "v=1"}},
+	}
+
+	r := newTestReplicator(t, stub, "udp")
+
+	for _, test := range tests {
+		result := query(r, test.query)
+
+		if result.Error != nil {
+			t.Errorf("%v %v: %v", test.query.Type, test.query.Name, result.Error)
+			continue
+		}
+
+		if !reflect.DeepEqual(result.Answers, test.want) {
+			t.Errorf("%v %v = %q, want %q", test.query.Type, test.query.Name, result.Answers, test.want)
+		}
+	}
+}
+
+func TestAnswerChanges(t *testing.T) {
+	stub, err := StartStub()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stub.Close()
+
+	r := newTestReplicator(t, stub, "udp")
+	q := Query{"change.test.", TypeA}
+
+	for i, answer := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.1"} {
+		stub.SetAnswers("change.test", TypeA, []string{answer})
+
+		if result := query(r, q); result.Error != nil {
+			t.Fatalf("query %v: %v", i, result.Error)
+		}
+	}
+
+	if r.AnswerChanges != 2 {
+		t.Errorf("AnswerChanges = %v, want 2", r.AnswerChanges)
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		recordType string
+		want       string
+		err        bool
+	}{
+		{"A", TypeA, false},
+		{" aaaa ", TypeAAAA, false},
+		{"srv", TypeSRV, false},
+		{"Txt", TypeTXT, false},
+		{"MX", "", true},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseType(test.recordType)
+
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("ParseType(%q) = %q, %v, want %q, error %v", test.recordType, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestRecordWrappedErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		want counts
+	}{
+		{context.DeadlineExceeded, counts{Timeouts: 1}},
+		{fmt.Errorf("lookup ok.test: %w", context.DeadlineExceeded), counts{Timeouts: 1}},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, counts{Timeouts: 1}},
+		{fmt.Errorf("wrapped: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true}), counts{Timeouts: 1}},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, counts{Timeouts: 1}},
+		{fmt.Errorf("wrapped: %w", &net.DNSError{Err: "no such host", IsNotFound: true}), counts{NXDomain: 1}},
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, counts{ServFail: 1}},
+		{errors.New("connection refused"), counts{OtherErrors: 1}},
+	}
+
+	for _, test := range tests {
+		r := &Replicator{TypeStats: make(map[string]int64), lastAnswers: make(map[Query]string)}
+		r.record(&Response{Query: Query{"ok.test.", TypeA}, Error: test.err})
+
+		if got := r.counts(); got != test.want {
+			t.Errorf("record(%v) counts = %+v, want %+v", test.err, got, test.want)
+		}
+	}
+}
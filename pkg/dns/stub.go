@@ -0,0 +1,341 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNS response codes the Stub can answer with
+const (
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeRefused  = 5
+)
+
+var recordTypes = map[uint16]string{1: TypeA, 28: TypeAAAA, 33: TypeSRV, 16: TypeTXT}
+
+// Stub is a small in-process DNS server over UDP and TCP on the same port,
+// it's a target that can't be the bottleneck and that fails on demand.
+//
+// Names answer from Answers when they're in it. Otherwise names starting with
+// "nxdomain." get NXDOMAIN, "servfail." SERVFAIL, "refused." REFUSED and
+// "timeout." are never answered, every other name resolves to 127.0.0.1, ::1,
+// a TXT of the name and an SRV pointing at the name
+type Stub struct {
+	// Addr is the "host:port" the stub listens on once started
+	Addr string
+	// Delay is how long the stub waits before each answer
+	Delay time.Duration
+	// Queries counts the queries received
+	Queries  int64
+	lock     sync.Mutex
+	answers  map[Query][]string
+	udp      net.PacketConn
+	tcp      net.Listener
+	shutdown chan struct{}
+}
+
+// StartStub starts a Stub listening on a free port of 127.0.0.1
+func StartStub() (*Stub, error) {
+	s := &Stub{answers: make(map[Query][]string), shutdown: make(chan struct{})}
+
+	// The UDP port has to be free for TCP as well, try a few before giving up
+	var err error
+
+	for i := 0; i < 10; i++ {
+		s.udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String())
+
+		if err == nil {
+			break
+		}
+
+		s.udp.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.Addr = s.udp.LocalAddr().String()
+
+	go s.serveUDP()
+	go s.serveTCP()
+
+	return s, nil
+}
+
+// SetAnswers makes name answer queries of recordType with answers, in the
+// same format the Replicator reports them. No answers means the name exists
+// without records of that type
+func (s *Stub) SetAnswers(name, recordType string, answers []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.answers[Query{Name: canonical(name), Type: recordType}] = answers
+}
+
+// Close stops the stub
+func (s *Stub) Close() error {
+	close(s.shutdown)
+	s.tcp.Close()
+	return s.udp.Close()
+}
+
+func (s *Stub) serveUDP() {
+	buffer := make([]byte, 65536)
+
+	for {
+		n, addr, err := s.udp.ReadFrom(buffer)
+
+		if err != nil {
+			return
+		}
+
+		query := append([]byte{}, buffer[:n]...)
+
+		go func() {
+			if reply := s.answer(query); reply != nil {
+				s.udp.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+func (s *Stub) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				length := make([]byte, 2)
+
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+
+				query := make([]byte, binary.BigEndian.Uint16(length))
+
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+
+				reply := s.answer(query)
+
+				if reply == nil {
+					// Hold the connection so the client times out
+					<-s.shutdown
+					return
+				}
+
+				binary.BigEndian.PutUint16(length, uint16(len(reply)))
+
+				if _, err := conn.Write(append(length, reply...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer builds the reply to a query message, nil means don't answer
+func (s *Stub) answer(message []byte) []byte {
+	atomic.AddInt64(&s.Queries, 1)
+
+	if len(message) < 12 || binary.BigEndian.Uint16(message[4:]) != 1 {
+		return nil
+	}
+
+	name, end, err := readName(message, 12)
+
+	if err != nil || end+4 > len(message) {
+		return nil
+	}
+
+	question := message[12 : end+4]
+	recordType := recordTypes[binary.BigEndian.Uint16(message[end:])]
+	rcode, answers := s.lookup(Query{Name: name, Type: recordType})
+
+	if rcode < 0 {
+		return nil
+	}
+
+	if s.Delay > 0 {
+		time.Sleep(s.Delay)
+	}
+
+	reply := make([]byte, 12, 512)
+	copy(reply, message[:2])
+	// QR, the query's opcode and RD, AA and RA
+	reply[2] = 0x84 | message[2]&0x79
+	reply[3] = 0x80 | byte(rcode)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	reply = append(reply, question...)
+
+	count := 0
+
+	for _, answer := range answers {
+		data, err := encodeAnswer(recordType, answer)
+
+		if err != nil {
+			continue
+		}
+
+		// A pointer back to the name in the question, then type, class IN and a TTL of 0
+		reply = append(reply, 0xC0, 12)
+		reply = append(reply, question[len(question)-4:len(question)-2]...)
+		reply = append(reply, 0, 1, 0, 0, 0, 0, byte(len(data)>>8), byte(len(data)))
+		reply = append(reply, data...)
+		count++
+	}
+
+	binary.BigEndian.PutUint16(reply[6:], uint16(count))
+
+	return reply
+}
+
+// lookup picks the rcode and answers for a query, an rcode under 0 means don't answer
+func (s *Stub) lookup(query Query) (int, []string) {
+	s.lock.Lock()
+	answers, ok := s.answers[query]
+	s.lock.Unlock()
+
+	if ok {
+		return RcodeSuccess, answers
+	}
+
+	switch {
+	case strings.HasPrefix(query.Name, "nxdomain."):
+		return RcodeNXDomain, nil
+	case strings.HasPrefix(query.Name, "servfail."):
+		return RcodeServFail, nil
+	case strings.HasPrefix(query.Name, "refused."):
+		return RcodeRefused, nil
+	case strings.HasPrefix(query.Name, "timeout."):
+		return -1, nil
+	}
+
+	switch query.Type {
+	case TypeA:
+		return RcodeSuccess, []string{"127.0.0.1"}
+	case TypeAAAA:
+		return RcodeSuccess, []string{"::1"}
+	case TypeTXT:
+		return RcodeSuccess, []string{query.Name}
+	case TypeSRV:
+		return RcodeSuccess, []string{query.Name + ".:53/10/10"}
+	}
+
+	return RcodeSuccess, nil
+}
+
+// encodeAnswer turns an answer in the Replicator's format into record data
+func encodeAnswer(recordType, answer string) ([]byte, error) {
+	switch recordType {
+	case TypeA, TypeAAAA:
+		ip := net.ParseIP(answer)
+
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %v", answer)
+		}
+
+		if recordType == TypeA {
+			return ip.To4(), nil
+		}
+
+		return ip.To16(), nil
+	case TypeTXT:
+		data := []byte{}
+
+		for len(answer) > 255 {
+			data = append(append(data, 255), answer[:255]...)
+			answer = answer[255:]
+		}
+
+		return append(append(data, byte(len(answer))), answer...), nil
+	case TypeSRV:
+		// target:port/priority/weight
+		fields := strings.FieldsFunc(answer, func(r rune) bool { return r == ':' || r == '/' })
+
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid SRV %v", answer)
+		}
+
+		data := make([]byte, 6)
+
+		for i, field := range []string{fields[2], fields[3], fields[1]} {
+			value, err := strconv.ParseUint(field, 10, 16)
+
+			if err != nil {
+				return nil, err
+			}
+
+			binary.BigEndian.PutUint16(data[i*2:], uint16(value))
+		}
+
+		return append(data, encodeName(fields[0])...), nil
+	}
+
+	return nil, fmt.Errorf("unsupported record type %v", recordType)
+}
+
+// readName reads an uncompressed name from a query, returning it in
+// lowercase without the trailing dot and where it ended
+func readName(message []byte, offset int) (string, int, error) {
+	labels := []string{}
+
+	for {
+		if offset >= len(message) {
+			return "", 0, fmt.Errorf("name runs past the message")
+		}
+
+		length := int(message[offset])
+		offset++
+
+		if length == 0 {
+			return canonical(strings.Join(labels, ".")), offset, nil
+		}
+
+		if length > 63 || offset+length > len(message) {
+			return "", 0, fmt.Errorf("invalid label")
+		}
+
+		labels = append(labels, string(message[offset:offset+length]))
+		offset += length
+	}
+}
+
+func encodeName(name string) []byte {
+	data := []byte{}
+
+	for _, label := range strings.Split(canonical(name), ".") {
+		if label != "" {
+			data = append(append(data, byte(len(label))), label...)
+		}
+	}
+
+	return append(data, 0)
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
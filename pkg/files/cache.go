@@ -0,0 +1,130 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alyssadaemon/troll/pkg/cgroup"
+)
+
+// Page cache policies, page cache counts against the cgroup memory limit
+const (
+	// CacheDefault leaves the page cache to the kernel
+	CacheDefault = "default"
+	// CacheKeep reads written files back over and over to keep them resident
+	CacheKeep = "keep"
+	// CacheDrop writes data back and evicts it from the page cache as soon as it's written
+	CacheDrop = "drop"
+)
+
+// The process's cgroup is resolved once, the page cache is reported every tick
+var (
+	group     *cgroup.Cgroup
+	groupErr  error
+	groupOnce sync.Once
+)
+
+type RereadResult struct {
+	Path     string
+	Bytes    int64
+	Duration time.Duration
+	Error    error
+}
+
+// ValidCache reports whether cache is one of the supported page cache policies
+func ValidCache(cache string) bool {
+	switch cache {
+	case CacheDefault, CacheKeep, CacheDrop:
+		return true
+	}
+
+	return false
+}
+
+// dropCache evicts file from the page cache. DONTNEED only drops clean
+// pages, so dirty ones are written back first
+func dropCache(file *os.File) error {
+	if err := fdatasync(file); err != nil {
+		return err
+	}
+
+	return fadviseDontNeed(file)
+}
+
+// reread reads path from start to end, pulling it into the page cache
+func reread(path string) *RereadResult {
+	startTime := time.Now()
+	result := &RereadResult{Path: path}
+	file, err := os.Open(path)
+
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	defer file.Close()
+
+	result.Bytes, result.Error = io.Copy(ioutil.Discard, file)
+	result.Duration = time.Since(startTime)
+
+	return result
+}
+
+// rereadRandom reads back one of the files sampled so far
+func (r *Replicator) rereadRandom(results chan<- *RereadResult) bool {
+	if len(r.sample) == 0 {
+		return false
+	}
+
+	go func(path string) {
+		results <- reread(path)
+	}(r.sample[rand.Intn(len(r.sample))].Path)
+
+	return true
+}
+
+func (r *Replicator) recordReread(result *RereadResult) {
+	r.Stalls.Check("reread", result.Path, result.Duration)
+
+	if result.Error != nil {
+		if os.IsNotExist(result.Error) && !r.tracked(result.Path) {
+			// Deleted by the retention policy while it was being read
+			return
+		}
+
+		r.RereadErrors++
+		fmt.Printf("Reread failed for %v: %v\n", result.Path, result.Error)
+		return
+	}
+
+	r.FilesReread++
+	r.BytesReread += result.Bytes
+}
+
+// pageCache describes the page cache charged to the process's cgroup
+func pageCache() string {
+	groupOnce.Do(func() {
+		group, groupErr = cgroup.Self()
+	})
+
+	if groupErr != nil {
+		return fmt.Sprintf("unavailable (%v)", groupErr)
+	}
+
+	cache, err := group.PageCache()
+
+	if err != nil {
+		return fmt.Sprintf("unavailable (%v)", err)
+	}
+
+	return cache.String()
+}
+
+func cacheStats() {
+	fmt.Printf("Page Cache (cgroup): %v\n", pageCache())
+}
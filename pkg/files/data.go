@@ -0,0 +1,172 @@
+package files
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// Data generators shape what gets written, storage with compression or dedup
+// behaves very differently depending on it
+const (
+	// DataRandom is incompressible random data
+	DataRandom = "random"
+	// DataZero is all zeros
+	DataZero = "zero"
+	// DataText is lines of english-like words
+	DataText = "text"
+	// DataCompressible mixes random and zero bytes to hit Generator.CompressRatio
+	DataCompressible = "compressible"
+)
+
+const (
+	// dedupBlockSize is the granularity data is generated and duplicated at
+	dedupBlockSize = Alignment
+	// dedupPoolSize is how many distinct blocks duplicate blocks are drawn from
+	dedupPoolSize = 64
+)
+
+var words = strings.Fields(`the of and to in is that for it as was with be by on not he this are or
+	his from at which but have an they you were her she there one all we their can has more will would
+	if no out so said what up its about into than them only other new some could time these two may then
+	do first any my now such like our over man me even most made after also did many before must through
+	back years where much your way well down should because each just those people how too little state
+	good very make world still own see men work long get here between both life being under never day
+	same another know while last might us great old year off come since against go came right used take`)
+
+// sources reuses seeded generators across Fill calls, seeding a new one for
+// every write costs more than generating a small block
+var sources = sync.Pool{
+	New: func() interface{} {
+		return rand.New(rand.NewSource(rand.Int63()))
+	},
+}
+
+var (
+	dedupPools     = make(map[Generator][][]byte)
+	dedupPoolsLock sync.Mutex
+)
+
+// Generator fills write buffers according to a data generator
+type Generator struct {
+	// Kind is one of the Data generators, empty means DataRandom
+	Kind string
+	// CompressRatio is the target compression ratio for DataCompressible, 2 means 2:1
+	CompressRatio float64
+	// DedupPercent is the percentage of blocks that repeat a block written before
+	DedupPercent float64
+}
+
+// ValidData reports whether kind is one of the supported data generators
+func ValidData(kind string) bool {
+	switch kind {
+	case DataRandom, DataZero, DataText, DataCompressible:
+		return true
+	}
+
+	return false
+}
+
+// Fill overwrites p with generated data. Duplicate blocks come from a small
+// pool seeded by their index so they match across buffers, files and runs
+func (g Generator) Fill(p []byte) {
+	rng := sources.Get().(*rand.Rand)
+	defer sources.Put(rng)
+
+	var pool [][]byte
+
+	if g.DedupPercent > 0 {
+		pool = g.dedupPool()
+	}
+
+	for offset := 0; offset < len(p); offset += dedupBlockSize {
+		end := offset + dedupBlockSize
+
+		if end > len(p) {
+			end = len(p)
+		}
+
+		if pool != nil && rng.Float64()*100 < g.DedupPercent {
+			copy(p[offset:end], pool[rng.Intn(dedupPoolSize)])
+			continue
+		}
+
+		g.fillBlock(p[offset:end], rng)
+	}
+}
+
+// dedupPool generates the blocks duplicates are copied from once per kind of
+// data, block i is always generated from seed i
+func (g Generator) dedupPool() [][]byte {
+	key := Generator{Kind: g.Kind, CompressRatio: g.CompressRatio}
+
+	dedupPoolsLock.Lock()
+	defer dedupPoolsLock.Unlock()
+
+	if pool, ok := dedupPools[key]; ok {
+		return pool
+	}
+
+	pool := make([][]byte, dedupPoolSize)
+
+	for i := range pool {
+		pool[i] = make([]byte, dedupBlockSize)
+		g.fillBlock(pool[i], rand.New(rand.NewSource(int64(i))))
+	}
+
+	dedupPools[key] = pool
+
+	return pool
+}
+
+func (g Generator) fillBlock(block []byte, rng *rand.Rand) {
+	switch g.Kind {
+	case DataZero:
+		zero(block)
+	case DataText:
+		fillText(block, rng)
+	case DataCompressible:
+		// Random bytes don't compress and zeros all but vanish, so the
+		// random share of each block sets the ratio
+		random := len(block)
+
+		if g.CompressRatio > 1 {
+			random = int(float64(len(block)) / g.CompressRatio)
+		}
+
+		rng.Read(block[:random])
+		zero(block[random:])
+	default:
+		rng.Read(block)
+	}
+}
+
+func fillText(block []byte, rng *rand.Rand) {
+	line := 0
+
+	for i := 0; i < len(block); {
+		word := words[rng.Intn(len(words))]
+		i += copy(block[i:], word)
+		line += len(word)
+
+		if i >= len(block) {
+			break
+		}
+
+		if line > 60+rng.Intn(20) {
+			block[i] = '\n'
+			line = 0
+		} else {
+			block[i] = ' '
+			line++
+		}
+
+		i++
+	}
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
@@ -0,0 +1,25 @@
+//go:build linux && !386 && !arm && !mips && !mipsle && !s390x
+// +build linux,!386,!arm,!mips,!mipsle,!s390x
+
+package files
+
+import (
+	"os"
+	"syscall"
+)
+
+// fadvDontNeed is POSIX_FADV_DONTNEED
+const fadvDontNeed = 4
+
+// fadviseDontNeed asks the kernel to drop the whole file's clean pages from
+// the page cache. 32 bit platforms split the offsets over registers, so they
+// aren't supported
+func fadviseDontNeed(file *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, fadvDontNeed, 0, 0)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux || 386 || arm || mips || mipsle || s390x
+// +build !linux 386 arm mips mipsle s390x
+
+package files
+
+import "os"
+
+func fadviseDontNeed(file *os.File) error {
+	return errNotSupported
+}
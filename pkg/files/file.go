@@ -3,13 +3,14 @@ package files
 import (
 	"context"
 	"fmt"
-	"math/rand"
-	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
 )
 
 type Response struct {
@@ -17,6 +18,9 @@ type Response struct {
 	Error    error
 	Written  int64
 	Duration time.Duration
+	// SyncDuration is time spent in fsync/fdatasync, it isn't part of Duration
+	SyncDuration time.Duration
+	Checksum     uint32
 }
 
 type Replicator struct {
@@ -35,6 +39,34 @@ type Replicator struct {
 	ShortestTime       time.Duration
 	LongestTime        time.Duration
 	TotalBytes         int64
+	// Sizes picks each file's size, an empty Kind picks uniformly up to
+	// MaxSize, or always MaxSize when RandomBytes is off
+	Sizes         SizeDistribution
+	FileSizes     stats.Distribution
+	Stalls        StallDetector
+	Options       Options
+	SyncLatency   stats.Latency
+	Verify        string
+	FilesVerified int64
+	CorruptFiles  int64
+	ShortReads    int64
+	MissingFiles  int64
+	VerifyErrors  int64
+	ReadLatency   stats.Latency
+	FilesDeleted  int64
+	BytesDeleted  int64
+	FilesReread   int64
+	BytesReread   int64
+	RereadErrors  int64
+	written       []writtenFile
+	liveBytes     int64
+	sample        []writtenFile
+	sampled       int64
+	// pending holds the files dispatched but not yet written, or that failed
+	pending          map[string]bool
+	workers          sync.WaitGroup
+	currentVerifiers int64
+	currentRereaders int64
 }
 
 func (r *Replicator) Stats() {
@@ -55,40 +87,102 @@ func (r *Replicator) Stats() {
 	fmt.Println("Final Stats:")
 	fmt.Printf("Total Run Duration %v\n", totalTime)
 	fmt.Printf("Max Concurrency %v\n", r.MaxWorkers)
-	fmt.Printf("Bytes Written %v (total) %v\n", r.MaxSize, r.MaxSize*r.FilesWritten)
+	fmt.Printf("Bytes Written %v (max file size %v)\n", r.TotalBytes, r.Sizes.Max)
+	fmt.Printf("File Sizes (%v): %v\n", r.Sizes.Kind, &r.FileSizes)
 	fmt.Printf("Total calls: %v (%v sucessfull, %v errors)\n", totalFiles, r.FilesWritten, r.ErrorFiles)
 	fmt.Printf("Avg Write Time: %v\n", avgRespTime)
 	fmt.Printf("Shortest Write Time: %v\n", r.ShortestTime)
 	fmt.Printf("Longest Response Time %v\n", r.LongestTime)
 
+	if r.Options.syncs() {
+		fmt.Printf("Sync Time (%v): %v\n", r.Options.Durability, &r.SyncLatency)
+	}
+
+	if r.Verify == VerifyConcurrent || r.Verify == VerifyAfter {
+		r.verifyStats()
+	}
+
+	r.Options.Limiter.Stats()
+
+	if r.Options.Retention.enabled() {
+		fmt.Printf("Files Deleted: %v (%v bytes), Files Left: %v (%v bytes)\n", r.FilesDeleted, r.BytesDeleted, len(r.written), r.liveBytes)
+	}
+
+	if r.Options.Cache == CacheKeep {
+		fmt.Printf("Files Reread: %v (%v bytes, %v errors)\n", r.FilesReread, r.BytesReread, r.RereadErrors)
+	}
+
+	cacheStats()
+	r.Stalls.Stats(r.StartTime)
+
 }
 
 func (r *Replicator) Run() {
 	r.StartTime = time.Now()
+	r.pending = make(map[string]bool)
 	results := make(chan *Response, r.MaxWorkers)
-	bytes := make([]byte, r.MaxSize)
+	verifyResults := make(chan *VerifyResult, r.MaxWorkers)
+	rereadResults := make(chan *RereadResult, r.MaxWorkers)
 
-	if !r.RandomBytes {
-		_, err := rand.Read(bytes)
+	if r.Sizes.Kind == "" {
+		r.Sizes.Kind = SizeUniform
 
-		if err != nil {
-			fmt.Println(err)
+		if !r.RandomBytes {
+			r.Sizes.Kind = SizeFixed
 		}
 	}
 
+	if r.Sizes.Max == 0 {
+		r.Sizes.Max = r.MaxSize
+	}
+
+	if err := r.Sizes.Init(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	bytes := r.Options.buffer(r.Sizes.Max)
+
+	if !r.RandomBytes {
+		r.Options.Data.Fill(bytes)
+	}
+
+	// results has room for every worker, so none of them block once Run returns
+	defer r.workers.Wait()
+
 	for {
 		select {
 		case <-r.Context.Done():
 			return
 		case result := <-results:
+			r.Stalls.Check("write", result.Path, result.Duration)
+			r.Stalls.Check("sync", result.Path, result.SyncDuration)
+
 			if result.Error != nil {
 				fmt.Printf("Got an error %v\n", result)
 				r.ErrorFiles++
 			} else {
 				r.FilesWritten++
+				delete(r.pending, result.Path)
 				fmt.Printf("%v: %v bytes %v\n", result.Path, result.Written, result.Duration)
 
 				r.TimeRunning += result.Duration
+				r.TotalBytes += result.Written
+				r.FileSizes.Add(result.Written)
+
+				if r.Options.syncs() {
+					r.SyncLatency.Add(result.SyncDuration)
+				}
+
+				file := writtenFile{Path: result.Path, Size: result.Written, Checksum: result.Checksum}
+
+				if r.Verify == VerifyAfter || r.Options.Retention.enabled() {
+					r.track(file)
+				}
+
+				if r.Verify == VerifyConcurrent || r.Options.Cache == CacheKeep {
+					r.addSample(file)
+				}
 
 				if r.ShortestTime > result.Duration {
 					r.ShortestTime = result.Duration
@@ -99,7 +193,36 @@ func (r *Replicator) Run() {
 				}
 			}
 			r.CurrentWorkers--
+		case result := <-verifyResults:
+			r.recordVerify(result)
+			r.currentVerifiers--
+		case result := <-rereadResults:
+			r.recordReread(result)
+			r.currentRereaders--
 		case <-r.Ticker.C:
+			r.Stalls.Tick()
+
+			full, used, err := r.Options.Retention.diskFull(r.RootPath)
+
+			if err != nil {
+				fmt.Printf("Unable to check disk usage %v\n", err)
+			} else if full {
+				fmt.Printf("Disk usage is %.2f%%, stopping\n", used)
+				return
+			}
+
+			if r.Verify == VerifyConcurrent {
+				for r.MaxWorkers > r.currentVerifiers && r.verifyRandom(verifyResults) {
+					r.currentVerifiers++
+				}
+			}
+
+			if r.Options.Cache == CacheKeep {
+				for r.MaxWorkers > r.currentRereaders && r.rereadRandom(rereadResults) {
+					r.currentRereaders++
+				}
+			}
+
 			if r.CurrentWorkers >= r.MaxWorkers {
 				continue
 			}
@@ -112,14 +235,23 @@ func (r *Replicator) Run() {
 				}
 
 				path := path.Join(r.RootPath, fileName.String())
-				size := rand.Int63n(r.MaxSize)
+				size := r.Options.alignSize(r.Sizes.Next())
 
-				if !r.RandomBytes {
-					go wrappedWriteFile(path, bytes, results)
-				} else {
-					go wrappedCreateAndWriteFile(path, size, results)
+				if r.Options.Retention.DeleteOnExit {
+					r.pending[path] = true
 				}
 
+				r.workers.Add(1)
+				go func(path string, size int64) {
+					defer r.workers.Done()
+
+					if !r.RandomBytes {
+						wrappedWriteFile(r.Context, path, bytes[:size], r.Options, results)
+					} else {
+						wrappedCreateAndWriteFile(r.Context, path, size, r.Options, results)
+					}
+				}(path, size)
+
 				r.CurrentWorkers++
 			}
 
@@ -127,107 +259,117 @@ func (r *Replicator) Run() {
 	}
 }
 
-func wrappedCreateAndWriteFile(path string, size int64, pipe chan<- *Response) {
-	startTime := time.Now()
-	written, err := CreateAndWriteFile(path, size)
-	duration := time.Since(startTime)
+func wrappedCreateAndWriteFile(ctx context.Context, path string, size int64, options Options, pipe chan<- *Response) {
+	bytes := options.buffer(size)
+	options.Data.Fill(bytes)
 
-	pipe <- &Response{
-		Path:     path,
-		Error:    err,
-		Written:  int64(written),
-		Duration: duration,
-	}
+	wrappedWriteFile(ctx, path, bytes, options, pipe)
 }
 
-func wrappedWriteFile(path string, body []byte, pipe chan<- *Response) {
+func wrappedWriteFile(ctx context.Context, path string, body []byte, options Options, pipe chan<- *Response) {
+	if err := options.Limiter.Wait(ctx, int64(len(body))); err != nil {
+		// The run is over, nobody is reading responses anymore
+		return
+	}
+
 	startTime := time.Now()
-	written, err := writeFile(path, body)
+	file, err := writeFile(path, body, options)
 	duration := time.Since(startTime)
 
-	pipe <- &Response{
+	response := &Response{
 		Path:     path,
 		Error:    err,
-		Written:  int64(written),
 		Duration: duration,
+		Checksum: Checksum(body),
 	}
-}
-
-func writeFile(path string, body []byte) (int, error) {
-	file, err := os.Create(path)
 
-	if err != nil {
-		return 0, err
+	if file != nil {
+		response.Written = file.Written
+		response.SyncDuration = file.SyncTime
+		response.Duration -= file.SyncTime
 	}
 
-	defer file.Close()
-
-	return file.Write(body)
+	pipe <- response
 }
 
-// CreateAndWriteFile creates and writes a file with a size of size filled with random bytes
-func CreateAndWriteFile(path string, size int64) (int, error) {
-	bytes := make([]byte, size)
-
-	_, err := rand.Read(bytes)
+// writeFile creates path and writes body to it, the returned file is already
+// closed and only useful for its timings
+func writeFile(path string, body []byte, options Options) (*syncedFile, error) {
+	file, err := createFile(path, options)
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return writeFile(path, bytes)
-
-}
+	_, err = file.Write(body)
 
-func NeverEndingRandomFile(path string, size int64) error {
-	bytes := make([]byte, size)
-	file, err := os.Create(path)
+	if err == nil && options.Cache == CacheDrop {
+		err = dropCache(file.file)
+	}
 
 	if err != nil {
-		return err
+		file.Close()
+		return file, err
 	}
 
-	defer file.Close()
-
-	for {
-		_, err := rand.Read(bytes)
+	return file, file.Close()
+}
 
-		if err != nil {
-			return err
-		}
+// CreateAndWriteFile creates and writes a file with a size of size filled by options.Data
+func CreateAndWriteFile(path string, size int64, options Options) (int, error) {
+	bytes := options.buffer(size)
+	options.Data.Fill(bytes)
 
-		_, err = file.Write(bytes)
+	file, err := writeFile(path, bytes, options)
 
-		if err != nil {
-			return err
-		}
+	if file == nil {
+		return 0, err
+	}
 
-		err = file.Sync()
+	return int(file.Written), err
 
-		if err != nil {
-			return err
-		}
+}
 
+// NeverEndingRandomFile keeps appending size bytes of freshly generated data to
+// path until the context is cancelled or a write fails. Without a Durability
+// every write is synced
+func NeverEndingRandomFile(ctx context.Context, path string, size int64, options Options) error {
+	if options.Durability == "" {
+		options.Durability = DurabilityFsync
 	}
-}
 
-func NeverEndingFile(path string, size int64) error {
-	bytes := make([]byte, size)
-	file, err := os.Create(path)
+	return neverEndingFile(ctx, path, size, true, options)
+}
 
-	if err != nil {
-		return err
+// NeverEndingFile keeps appending the same size bytes to path until the
+// context is cancelled or a write fails. Without a Data.Kind the bytes are zeros
+func NeverEndingFile(ctx context.Context, path string, size int64, options Options) error {
+	if options.Data.Kind == "" {
+		options.Data.Kind = DataZero
 	}
 
-	defer file.Close()
+	return neverEndingFile(ctx, path, size, false, options)
+}
 
-	for {
+func neverEndingFile(ctx context.Context, path string, size int64, random bool, options Options) error {
+	filler := Filler{
+		Context: ctx,
+		Ticker:  time.NewTicker(time.Second),
+		Paths:   []string{path},
+		Size:    size,
+		Writers: 1,
+		Random:  random,
+		Options: options,
+	}
 
-		_, err = file.Write(bytes)
+	defer filler.Ticker.Stop()
 
-		if err != nil {
-			return err
-		}
+	err := filler.Run()
 
+	// Without a start time the file was never opened, there is nothing to report
+	if !filler.StartTime.IsZero() {
+		filler.Stats()
 	}
+
+	return err
 }
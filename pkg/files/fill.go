@@ -0,0 +1,369 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+type fillResult struct {
+	// Reread marks bytes read back to keep the files in the page cache
+	Reread       bool
+	Path         string
+	Bytes        int
+	Duration     time.Duration
+	Synced       bool
+	SyncDuration time.Duration
+	Error        error
+}
+
+// fillTarget is one file being filled, shared by every writer
+type fillTarget struct {
+	path     string
+	file     *os.File
+	mutex    sync.Mutex
+	next     int64
+	unsynced int64
+}
+
+// Filler keeps writing Size byte blocks into Paths with Writers goroutines
+// until the context is cancelled or a write fails. Writers round robin over
+// the files, either appending or, with Pwrite, writing at disjoint offsets
+type Filler struct {
+	Context context.Context
+	Ticker  *time.Ticker
+	Paths   []string
+	Size    int64
+	Writers int64
+	// Pwrite reserves a distinct offset for every write instead of using O_APPEND
+	Pwrite bool
+	// Random generates fresh data for every write instead of reusing one buffer
+	Random       bool
+	Options      Options
+	StartTime    time.Time
+	BytesWritten int64
+	Writes       int64
+	Errors       int64
+	BytesReread  int64
+	RereadErrors int64
+	Stalls       StallDetector
+	WriteLatency stats.Latency
+	SyncLatency  stats.Latency
+	targets      []*fillTarget
+	lastReport   time.Time
+	lastBytes    int64
+	lastWrites   int64
+}
+
+func (f *Filler) Stats() {
+	totalTime := time.Since(f.StartTime)
+	mode := "append"
+
+	if f.Pwrite {
+		mode = "pwrite"
+	}
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+	fmt.Printf("Writers: %v, Files: %v (%v)\n", f.Writers, len(f.Paths), mode)
+	fmt.Printf("Bytes Written %v\n", f.BytesWritten)
+	fmt.Printf("Total writes: %v (%v errors)\n", f.Writes, f.Errors)
+	fmt.Printf("Throughput: %.2f MB/s, %.2f writes/sec\n", perSecond(f.BytesWritten, totalTime)/1e6, perSecond(f.Writes, totalTime))
+	fmt.Printf("Write Time: %v\n", &f.WriteLatency)
+
+	if f.Options.syncs() {
+		fmt.Printf("Sync Time (%v): %v\n", f.Options.Durability, &f.SyncLatency)
+	}
+
+	if f.Options.Cache == CacheKeep {
+		fmt.Printf("Bytes Reread: %v (%v errors)\n", f.BytesReread, f.RereadErrors)
+	}
+
+	f.Options.Limiter.Stats()
+	cacheStats()
+	f.Stalls.Stats(f.StartTime)
+}
+
+func (f *Filler) Run() error {
+	if len(f.Paths) == 0 || f.Writers <= 0 {
+		return fmt.Errorf("need at least one file and one writer")
+	}
+
+	if f.Options.syncs() && f.Options.SyncEvery == 0 {
+		// There is no end of file to sync at, so sync every write instead
+		f.Options.SyncEvery = f.Options.alignSize(f.Size)
+	}
+
+	if err := f.open(); err != nil {
+		f.close()
+		return err
+	}
+
+	defer f.close()
+
+	f.StartTime = time.Now()
+	f.lastReport = f.StartTime
+
+	ctx, cancel := context.WithCancel(f.Context)
+	results := make(chan *fillResult, f.Writers)
+	wg := sync.WaitGroup{}
+
+	defer wg.Wait()
+	defer cancel()
+
+	for i := int64(0); i < f.Writers; i++ {
+		wg.Add(1)
+		go func(writer int64) {
+			defer wg.Done()
+			f.write(ctx, writer, results)
+		}(i)
+	}
+
+	if f.Options.Cache == CacheKeep {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.reread(ctx, results)
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case result := <-results:
+			if !result.Reread {
+				f.Stalls.Check("write", result.Path, result.Duration)
+				f.Stalls.Check("sync", result.Path, result.SyncDuration)
+			}
+
+			if result.Reread {
+				if result.Error != nil {
+					// Losing the cache isn't worth ending the run over
+					f.RereadErrors++
+					fmt.Printf("Reread failed for %v: %v\n", result.Path, result.Error)
+					continue
+				}
+
+				f.BytesReread += int64(result.Bytes)
+				continue
+			}
+
+			if result.Error != nil {
+				f.Errors++
+				return result.Error
+			}
+
+			f.Writes++
+			f.BytesWritten += int64(result.Bytes)
+			f.WriteLatency.Add(result.Duration)
+
+			if result.Synced {
+				f.SyncLatency.Add(result.SyncDuration)
+			}
+		case <-f.Ticker.C:
+			f.Stalls.Tick()
+			interval := time.Since(f.lastReport)
+			fmt.Printf("%.2f MB/s, %.2f writes/sec, %v bytes written, page cache %v\n", perSecond(f.BytesWritten-f.lastBytes, interval)/1e6, perSecond(f.Writes-f.lastWrites, interval), f.BytesWritten, pageCache())
+			f.lastReport = time.Now()
+			f.lastBytes = f.BytesWritten
+			f.lastWrites = f.Writes
+
+			full, used, err := f.Options.Retention.diskFull(f.Paths[0])
+
+			if err != nil {
+				return err
+			}
+
+			if full {
+				fmt.Printf("Disk usage is %.2f%%, stopping\n", used)
+				return nil
+			}
+		}
+	}
+}
+
+func (f *Filler) open() error {
+	flags, err := openFlags(f.Options)
+
+	if err != nil {
+		return err
+	}
+
+	flags |= os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+
+	if !f.Pwrite {
+		flags |= os.O_APPEND
+	}
+
+	for _, path := range f.Paths {
+		file, err := os.OpenFile(path, flags, 0666)
+
+		if err != nil {
+			return err
+		}
+
+		f.targets = append(f.targets, &fillTarget{path: path, file: file})
+	}
+
+	return nil
+}
+
+func (f *Filler) close() {
+	for _, target := range f.targets {
+		target.file.Close()
+		f.Options.Retention.Cleanup(target.path)
+	}
+}
+
+func (f *Filler) write(ctx context.Context, writer int64, results chan<- *fillResult) {
+	buffer := f.Options.buffer(f.Size)
+	f.Options.Data.Fill(buffer)
+
+	for i := writer; ; i++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if f.Random {
+			f.Options.Data.Fill(buffer)
+		}
+
+		if err := f.Options.Limiter.Wait(ctx, int64(len(buffer))); err != nil {
+			return
+		}
+
+		target := f.targets[i%int64(len(f.targets))]
+		result := &fillResult{Path: target.path}
+
+		var err error
+
+		result.Bytes, result.Duration, err = target.write(buffer, f.Options.Retention.MaxBytes, f.Pwrite)
+
+		if err == nil && target.due(int64(result.Bytes), f.Options.SyncEvery) {
+			startTime := time.Now()
+
+			if f.Options.Durability == DurabilityFdatasync {
+				err = fdatasync(target.file)
+			} else {
+				err = target.file.Sync()
+			}
+
+			result.Synced = true
+			result.SyncDuration = time.Since(startTime)
+		}
+
+		if err == nil && f.Options.Cache == CacheDrop {
+			err = dropCache(target.file)
+		}
+
+		result.Error = err
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reread keeps reading the files back so they stay in the page cache
+func (f *Filler) reread(ctx context.Context, results chan<- *fillResult) {
+	for i := 0; ; i++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		reread := reread(f.Paths[i%len(f.Paths)])
+
+		select {
+		case results <- &fillResult{Reread: true, Path: reread.Path, Bytes: int(reread.Bytes), Error: reread.Error}:
+		case <-ctx.Done():
+			return
+		}
+
+		if reread.Error != nil {
+			// Back off instead of spinning on a file that can't be read
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// write claims the next len(buffer) bytes of the file and writes them, starting
+// the file over from the beginning when it would grow past maxBytes. Appends
+// then hold the lock through the write, otherwise an append in flight could
+// land after the truncate and push the file past maxBytes
+func (t *fillTarget) write(buffer []byte, maxBytes int64, pwrite bool) (int, time.Duration, error) {
+	size := int64(len(buffer))
+	serialize := maxBytes > 0 && !pwrite
+
+	t.mutex.Lock()
+
+	if maxBytes > 0 && t.next+size > maxBytes {
+		t.next = 0
+
+		if !pwrite {
+			// O_APPEND writes follow the new end of file
+			if err := t.file.Truncate(0); err != nil {
+				t.mutex.Unlock()
+				return 0, 0, err
+			}
+		}
+	}
+
+	offset := t.next
+	t.next += size
+
+	if !serialize {
+		t.mutex.Unlock()
+	}
+
+	startTime := time.Now()
+
+	var n int
+	var err error
+
+	if pwrite {
+		n, err = t.file.WriteAt(buffer, offset)
+	} else {
+		n, err = t.file.Write(buffer)
+	}
+
+	duration := time.Since(startTime)
+
+	if serialize {
+		t.mutex.Unlock()
+	}
+
+	return n, duration, err
+}
+
+// due records written bytes and reports whether the caller should sync
+func (t *fillTarget) due(written, syncEvery int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.unsynced += written
+
+	if syncEvery <= 0 || t.unsynced < syncEvery {
+		return false
+	}
+
+	t.unsynced = 0
+
+	return true
+}
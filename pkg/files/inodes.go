@@ -0,0 +1,253 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// filesPerDir keeps directories small enough that creating files stays cheap
+const filesPerDir = 10000
+
+type inodeSample struct {
+	Time time.Time
+	Used uint64
+	Free uint64
+}
+
+// InodePressure creates small files under RootPath until the filesystem has
+// used TargetPercent of its inodes, holds it there and then removes them
+type InodePressure struct {
+	Context context.Context
+	Ticker  *time.Ticker
+	// RootPath is where the tree of files is created
+	RootPath string
+	// TargetPercent is the inode usage percentage to reach
+	TargetPercent float64
+	// HoldTime is how long to hold the target once reached, 0 holds until exit
+	HoldTime time.Duration
+	// FileSize is how many bytes go in each file, 0 creates empty files
+	FileSize     int64
+	StartTime    time.Time
+	ReachedTime  time.Duration
+	CleanupTime  time.Duration
+	FilesCreated int64
+	Errors       int64
+	root         string
+	dir          string
+	body         []byte
+	samples      []inodeSample
+	full         bool
+	lastReport   time.Time
+	lastCreated  int64
+}
+
+func (p *InodePressure) Stats() {
+	totalTime := time.Since(p.StartTime)
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+
+	if p.ReachedTime > 0 {
+		fmt.Printf("Time To Reach Target: %v\n", p.ReachedTime)
+	} else {
+		fmt.Println("Target was never reached")
+	}
+
+	fmt.Printf("Files Created: %v, Errors: %v\n", p.FilesCreated, p.Errors)
+	fmt.Printf("Cleanup Time: %v\n", p.CleanupTime)
+
+	if len(p.samples) == 0 {
+		return
+	}
+
+	fmt.Println("Inode Timeline:")
+
+	step := len(p.samples)/maxTimeline + 1
+
+	for i, sample := range p.samples {
+		if i%step != 0 && i != len(p.samples)-1 {
+			continue
+		}
+
+		fmt.Printf("\t%v\t%v inodes used\t%v free\n", sample.Time.Sub(p.StartTime).Truncate(time.Millisecond), sample.Used, sample.Free)
+	}
+}
+
+func (p *InodePressure) Run() error {
+	p.StartTime = time.Now()
+	p.lastReport = p.StartTime
+	p.body = make([]byte, p.FileSize)
+
+	usage, err := statfs(p.RootPath)
+
+	if err != nil {
+		return err
+	}
+
+	if usage.Inodes == 0 {
+		return fmt.Errorf("the filesystem under %v does not report an inode limit", p.RootPath)
+	}
+
+	id, err := uuid.NewRandom()
+
+	if err != nil {
+		return err
+	}
+
+	p.root = path.Join(p.RootPath, "troll-inodes-"+id.String())
+
+	if err := os.Mkdir(p.root, 0755); err != nil {
+		return err
+	}
+
+	defer p.cleanup()
+
+	var holdStart time.Time
+
+	for {
+		usage, err := statfs(p.RootPath)
+
+		if err != nil {
+			return err
+		}
+
+		p.sample(usage)
+
+		used := usage.Inodes - usage.FreeInodes
+		target := uint64(float64(usage.Inodes) * p.TargetPercent / 100)
+
+		if p.ReachedTime == 0 && used >= target {
+			p.reached()
+			holdStart = time.Now()
+		}
+
+		if p.ReachedTime > 0 && p.HoldTime > 0 && time.Since(holdStart) >= p.HoldTime {
+			fmt.Printf("Held target for %v, cleaning up\n", p.HoldTime)
+			return nil
+		}
+
+		if used < target && !p.full {
+			full, ticked := p.create(int64(target - used))
+
+			// Free inodes can be reserved or out of quota, there are no more to take
+			p.full = full
+
+			if full && p.ReachedTime == 0 {
+				fmt.Println("The filesystem filled up before reaching the target")
+				p.reached()
+				holdStart = time.Now()
+			}
+
+			if ticked {
+				continue
+			}
+		}
+
+		select {
+		case <-p.Context.Done():
+			return nil
+		case <-p.Ticker.C:
+		}
+	}
+}
+
+func (p *InodePressure) reached() {
+	p.ReachedTime = time.Since(p.StartTime)
+	fmt.Printf("Reached target after %v\n", p.ReachedTime)
+}
+
+func (p *InodePressure) sample(usage diskUsage) {
+	interval := time.Since(p.lastReport)
+	created := p.FilesCreated - p.lastCreated
+
+	p.samples = append(p.samples, inodeSample{Time: time.Now(), Used: usage.Inodes - usage.FreeInodes, Free: usage.FreeInodes})
+	fmt.Printf("%v inodes used, %v free, %.2f%% used, %v files created (%.2f/sec)\n", usage.Inodes-usage.FreeInodes, usage.FreeInodes, usage.InodesUsedPercent(), p.FilesCreated, perSecond(created, interval))
+
+	p.lastReport = time.Now()
+	p.lastCreated = p.FilesCreated
+}
+
+// create makes up to count files, stopping early when the ticker fires so
+// progress keeps being reported. full is set once the filesystem refuses to
+// give out more inodes
+func (p *InodePressure) create(count int64) (full bool, ticked bool) {
+	for i := int64(0); i < count; i++ {
+		select {
+		case <-p.Context.Done():
+			return false, false
+		case <-p.Ticker.C:
+			return false, true
+		default:
+		}
+
+		if p.FilesCreated%filesPerDir == 0 {
+			p.dir = path.Join(p.root, fmt.Sprintf("d%v", p.FilesCreated/filesPerDir))
+
+			if err := os.Mkdir(p.dir, 0755); err != nil && !os.IsExist(err) {
+				p.Errors++
+				fmt.Printf("Unable to create a directory: %v\n", err)
+				return isNoSpace(err), false
+			}
+		}
+
+		if err := p.createFile(path.Join(p.dir, fmt.Sprintf("f%v", p.FilesCreated))); err != nil {
+			p.Errors++
+			fmt.Printf("Unable to create a file: %v\n", err)
+			return isNoSpace(err), false
+		}
+	}
+
+	return false, false
+}
+
+func (p *InodePressure) createFile(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	// The inode is in use from here on even if the write fails
+	p.FilesCreated++
+
+	if len(p.body) > 0 {
+		if _, err := file.Write(p.body); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return file.Close()
+}
+
+// cleanup removes every file created and records the inodes coming back
+func (p *InodePressure) cleanup() {
+	fmt.Printf("Deleting %v files under %v\n", p.FilesCreated, p.root)
+
+	startTime := time.Now()
+
+	if err := os.RemoveAll(p.root); err != nil {
+		p.Errors++
+		fmt.Printf("Unable to delete %v: %v\n", p.root, err)
+	}
+
+	p.CleanupTime = time.Since(startTime)
+
+	if usage, err := statfs(p.RootPath); err == nil {
+		p.samples = append(p.samples, inodeSample{Time: time.Now(), Used: usage.Inodes - usage.FreeInodes, Free: usage.FreeInodes})
+	}
+}
+
+// isNoSpace reports whether err means the filesystem or a quota ran out
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
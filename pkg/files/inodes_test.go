@@ -0,0 +1,31 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsNoSpace(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{syscall.ENOSPC, true},
+		{syscall.EDQUOT, true},
+		{&os.PathError{Op: "open", Path: "f", Err: syscall.ENOSPC}, true},
+		{&os.PathError{Op: "write", Path: "f", Err: syscall.EDQUOT}, true},
+		{fmt.Errorf("create: %w", syscall.EDQUOT), true},
+		{&os.PathError{Op: "open", Path: "f", Err: syscall.EACCES}, false},
+		{errors.New("no space left on device"), false},
+	}
+
+	for _, test := range tests {
+		if got := isNoSpace(test.err); got != test.want {
+			t.Errorf("isNoSpace(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
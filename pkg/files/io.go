@@ -0,0 +1,345 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+// Access patterns follow fio's rw= names
+const (
+	PatternRead      = "read"
+	PatternWrite     = "write"
+	PatternRandRead  = "randread"
+	PatternRandWrite = "randwrite"
+	PatternReadWrite = "readwrite"
+	PatternRandRW    = "randrw"
+)
+
+type IOResult struct {
+	Read     bool
+	Bytes    int
+	Duration time.Duration
+	Synced   bool
+	// SyncDuration is time spent in fsync/fdatasync, it isn't part of Duration
+	SyncDuration time.Duration
+	Error        error
+}
+
+// IOReplicator runs block I/O against a preallocated set of files keeping
+// QueueDepth operations outstanding at all times. Options apply to every I/O:
+// Durability, SyncEvery, Cache drop, the Limiter and Data for what's written
+type IOReplicator struct {
+	Context      context.Context
+	Ticker       *time.Ticker
+	RootPath     string
+	Files        int64
+	FileSize     int64
+	BlockSize    int64
+	QueueDepth   int64
+	Pattern      string
+	ReadPercent  int64
+	Options      Options
+	StartTime    time.Time
+	Reads        int64
+	Writes       int64
+	ReadBytes    int64
+	WriteBytes   int64
+	Errors       int64
+	ReadLatency  stats.Latency
+	WriteLatency stats.Latency
+	SyncLatency  stats.Latency
+	targets      []*fillTarget
+	offsets      []int64
+	buffers      chan []byte
+	lastReport   time.Time
+	lastReads    int64
+	lastWrites   int64
+	inflight     sync.WaitGroup
+}
+
+// ValidPattern reports whether pattern is one of the supported access patterns
+func ValidPattern(pattern string) bool {
+	switch pattern {
+	case PatternRead, PatternWrite, PatternRandRead, PatternRandWrite, PatternReadWrite, PatternRandRW:
+		return true
+	}
+
+	return false
+}
+
+func (r *IOReplicator) Stats() {
+	totalTime := time.Since(r.StartTime)
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+	fmt.Printf("Pattern: %v, Block Size: %v, Queue Depth: %v, Files: %v x %v bytes\n", r.Pattern, r.BlockSize, r.QueueDepth, r.Files, r.FileSize)
+	fmt.Printf("Errors: %v\n", r.Errors)
+	fmt.Printf("Read: %v ops, %v bytes, %.2f IOPS, %.2f MB/s\n", r.Reads, r.ReadBytes, perSecond(r.Reads, totalTime), perSecond(r.ReadBytes, totalTime)/1e6)
+	fmt.Printf("Read Latency: %v\n", &r.ReadLatency)
+	fmt.Printf("Write: %v ops, %v bytes, %.2f IOPS, %.2f MB/s\n", r.Writes, r.WriteBytes, perSecond(r.Writes, totalTime), perSecond(r.WriteBytes, totalTime)/1e6)
+	fmt.Printf("Write Latency: %v\n", &r.WriteLatency)
+
+	if r.Options.syncs() {
+		fmt.Printf("Sync Time (%v): %v\n", r.Options.Durability, &r.SyncLatency)
+	}
+
+	r.Options.Limiter.Stats()
+
+	cacheStats()
+}
+
+func (r *IOReplicator) Run() error {
+	if r.BlockSize <= 0 || r.FileSize < r.BlockSize {
+		return fmt.Errorf("file size %v must be at least the block size %v", r.FileSize, r.BlockSize)
+	}
+
+	if r.Files <= 0 || r.QueueDepth <= 0 {
+		return fmt.Errorf("need at least one file and a queue depth of at least one")
+	}
+
+	if r.Options.Durability == DurabilityDirect && r.BlockSize%Alignment != 0 {
+		// Offsets are multiples of the block size, so this aligns them as well
+		return fmt.Errorf("block size %v must be a multiple of %v with O_DIRECT", r.BlockSize, Alignment)
+	}
+
+	if r.Options.syncs() && r.Options.SyncEvery == 0 {
+		// There is no end of file to sync at, so sync every write instead
+		r.Options.SyncEvery = r.BlockSize
+	}
+
+	defer r.close()
+
+	if err := r.prepare(); err != nil {
+		return err
+	}
+
+	defer r.inflight.Wait()
+
+	r.StartTime = time.Now()
+	r.lastReport = r.StartTime
+	results := make(chan *IOResult, r.QueueDepth)
+
+	for i := int64(0); i < r.QueueDepth; i++ {
+		r.dispatch(results)
+	}
+
+	for {
+		select {
+		case <-r.Context.Done():
+			return nil
+		case result := <-results:
+			if result.Error != nil {
+				fmt.Printf("Got an error %v\n", result.Error)
+				r.Errors++
+			} else if result.Read {
+				r.Reads++
+				r.ReadBytes += int64(result.Bytes)
+				r.ReadLatency.Add(result.Duration)
+			} else {
+				r.Writes++
+				r.WriteBytes += int64(result.Bytes)
+				r.WriteLatency.Add(result.Duration)
+			}
+
+			if result.Synced {
+				r.SyncLatency.Add(result.SyncDuration)
+			}
+
+			r.dispatch(results)
+		case <-r.Ticker.C:
+			interval := time.Since(r.lastReport)
+			fmt.Printf("read: %.2f IOPS, write: %.2f IOPS\n", perSecond(r.Reads-r.lastReads, interval), perSecond(r.Writes-r.lastWrites, interval))
+			r.lastReport = time.Now()
+			r.lastReads = r.Reads
+			r.lastWrites = r.Writes
+		}
+	}
+}
+
+// prepare creates the file set, filling each file so reads hit real blocks.
+// Files are filled through the page cache and then opened again with the
+// flags the durability mode needs
+func (r *IOReplicator) prepare() error {
+	flags, err := openFlags(r.Options)
+
+	if err != nil {
+		return err
+	}
+
+	r.buffers = make(chan []byte, r.QueueDepth)
+
+	for i := int64(0); i < r.QueueDepth; i++ {
+		buffer := r.Options.buffer(r.BlockSize)
+		r.Options.Data.Fill(buffer)
+		r.buffers <- buffer
+	}
+
+	chunk := make([]byte, 1<<20)
+	r.Options.Data.Fill(chunk)
+
+	for i := int64(0); i < r.Files; i++ {
+		filePath := path.Join(r.RootPath, fmt.Sprintf("troll-io-%v", i))
+
+		if err := r.preallocate(filePath, chunk); err != nil {
+			r.Options.Retention.Cleanup(filePath)
+			return err
+		}
+
+		file, err := os.OpenFile(filePath, flags|os.O_RDWR, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		r.targets = append(r.targets, &fillTarget{path: filePath, file: file})
+		r.offsets = append(r.offsets, 0)
+	}
+
+	return nil
+}
+
+// preallocate creates filePath and fills it up to FileSize unless it's already that big
+func (r *IOReplicator) preallocate(filePath string, chunk []byte) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if info.Size() >= r.FileSize {
+		return nil
+	}
+
+	fmt.Printf("Preallocating %v with %v bytes\n", filePath, r.FileSize)
+
+	for written := int64(0); written < r.FileSize; written += int64(len(chunk)) {
+		if remaining := r.FileSize - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		if _, err := file.WriteAt(chunk, written); err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+// close closes the file set, deleting it when DeleteOnExit is set
+func (r *IOReplicator) close() {
+	for _, target := range r.targets {
+		target.file.Close()
+		r.Options.Retention.Cleanup(target.path)
+	}
+}
+
+// dispatch picks the next operation and starts it, offsets are chosen here so
+// sequential patterns stay sequential no matter how deep the queue is
+func (r *IOReplicator) dispatch(results chan<- *IOResult) {
+	index := rand.Intn(len(r.targets))
+	blocks := r.FileSize / r.BlockSize
+	offset := int64(0)
+
+	switch r.Pattern {
+	case PatternRandRead, PatternRandWrite, PatternRandRW:
+		offset = rand.Int63n(blocks) * r.BlockSize
+	default:
+		offset = r.offsets[index]
+		r.offsets[index] += r.BlockSize
+
+		if r.offsets[index]+r.BlockSize > r.FileSize {
+			r.offsets[index] = 0
+		}
+	}
+
+	read := false
+
+	switch r.Pattern {
+	case PatternRead, PatternRandRead:
+		read = true
+	case PatternReadWrite, PatternRandRW:
+		read = rand.Int63n(100) < r.ReadPercent
+	}
+
+	r.inflight.Add(1)
+	go func(target *fillTarget, offset int64, read bool) {
+		defer r.inflight.Done()
+
+		if err := r.Options.Limiter.Wait(r.Context, r.BlockSize); err != nil {
+			// The run is over, nobody is reading results anymore
+			return
+		}
+
+		buffer := <-r.buffers
+		result := r.execute(target, buffer, offset, read)
+		r.buffers <- buffer
+
+		select {
+		case results <- result:
+		case <-r.Context.Done():
+		}
+	}(r.targets[index], offset, read)
+}
+
+// execute runs one I/O, syncing and dropping the page cache after it as the
+// options ask
+func (r *IOReplicator) execute(target *fillTarget, buffer []byte, offset int64, read bool) *IOResult {
+	result := &IOResult{Read: read}
+	startTime := time.Now()
+
+	var err error
+
+	if read {
+		result.Bytes, err = target.file.ReadAt(buffer, offset)
+	} else {
+		result.Bytes, err = target.file.WriteAt(buffer, offset)
+	}
+
+	result.Duration = time.Since(startTime)
+
+	if err == nil && !read && target.due(int64(result.Bytes), r.Options.SyncEvery) {
+		startTime := time.Now()
+
+		if r.Options.Durability == DurabilityFdatasync {
+			err = fdatasync(target.file)
+		} else {
+			err = target.file.Sync()
+		}
+
+		result.Synced = true
+		result.SyncDuration = time.Since(startTime)
+	}
+
+	if err == nil && r.Options.Cache == CacheDrop {
+		err = dropCache(target.file)
+	}
+
+	result.Error = err
+
+	return result
+}
+
+func perSecond(count int64, duration time.Duration) float64 {
+	if duration.Seconds() <= 0 {
+		return 0
+	}
+
+	return float64(count) / duration.Seconds()
+}
@@ -0,0 +1,129 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket capping writes to BytesPerSecond and
+// OpsPerSecond. Buckets start empty so runs don't open with a burst, and hold
+// at most one second worth of tokens. A nil Limiter never waits
+type Limiter struct {
+	BytesPerSecond int64
+	OpsPerSecond   int64
+	// Bytes and Ops count every write let through so far
+	Bytes      int64
+	Ops        int64
+	mutex      sync.Mutex
+	startTime  time.Time
+	lastRefill time.Time
+	byteTokens float64
+	opTokens   float64
+}
+
+// NewLimiter returns a Limiter for the given rates, or nil if both are 0
+func NewLimiter(bytesPerSecond, opsPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 && opsPerSecond <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		BytesPerSecond: bytesPerSecond,
+		OpsPerSecond:   opsPerSecond,
+	}
+}
+
+// Wait blocks until a write of size bytes fits under the limits. Writes
+// bigger than the bucket go into debt, which later writes wait off
+func (l *Limiter) Wait(ctx context.Context, size int64) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+
+	now := time.Now()
+
+	if l.startTime.IsZero() {
+		l.startTime = now
+		l.lastRefill = now
+	}
+
+	elapsed := now.Sub(l.lastRefill).Seconds()
+	l.lastRefill = now
+	wait := time.Duration(0)
+
+	if l.BytesPerSecond > 0 {
+		l.byteTokens = refill(l.byteTokens, elapsed, l.BytesPerSecond) - float64(size)
+
+		if l.byteTokens < 0 {
+			wait = time.Duration(-l.byteTokens / float64(l.BytesPerSecond) * float64(time.Second))
+		}
+	}
+
+	if l.OpsPerSecond > 0 {
+		l.opTokens = refill(l.opTokens, elapsed, l.OpsPerSecond) - 1
+
+		if l.opTokens < 0 {
+			if opWait := time.Duration(-l.opTokens / float64(l.OpsPerSecond) * float64(time.Second)); opWait > wait {
+				wait = opWait
+			}
+		}
+	}
+
+	l.mutex.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	l.mutex.Lock()
+	l.Bytes += size
+	l.Ops++
+	l.mutex.Unlock()
+
+	return nil
+}
+
+func refill(tokens, elapsed float64, rate int64) float64 {
+	tokens += elapsed * float64(rate)
+
+	if tokens > float64(rate) {
+		return float64(rate)
+	}
+
+	return tokens
+}
+
+// Stats prints the achieved rates next to the targets
+func (l *Limiter) Stats() {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	duration := time.Duration(0)
+
+	if !l.startTime.IsZero() {
+		duration = time.Since(l.startTime)
+	}
+
+	if l.BytesPerSecond > 0 {
+		fmt.Printf("Throughput Limit: %.2f MB/s target, %.2f MB/s achieved\n", float64(l.BytesPerSecond)/1e6, perSecond(l.Bytes, duration)/1e6)
+	}
+
+	if l.OpsPerSecond > 0 {
+		fmt.Printf("IOPS Limit: %v target, %.2f achieved\n", l.OpsPerSecond, perSecond(l.Ops, duration))
+	}
+}
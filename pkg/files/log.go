@@ -0,0 +1,361 @@
+package files
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+// LogName is the name of the active log file under RootPath
+const LogName = "troll.log"
+
+type compressResult struct {
+	Path     string
+	Before   int64
+	After    int64
+	Duration time.Duration
+	Error    error
+}
+
+// rotatedLog is a log file that has been rotated away from LogName
+type rotatedLog struct {
+	path        string
+	compressing bool
+}
+
+// LogWriter emulates an application logging to RootPath: it appends lines
+// sized by LineSizes at LinesPerSecond, rotating the log by size or age like
+// logrotate, optionally gzipping and pruning old logs
+type LogWriter struct {
+	Context        context.Context
+	Ticker         *time.Ticker
+	RootPath       string
+	LinesPerSecond int64
+	// LineSizes picks each line's size, an empty Kind picks uniformly
+	LineSizes SizeDistribution
+	// RotateSize rotates the log once it reaches this many bytes, 0 disables
+	RotateSize int64
+	// RotateEvery rotates the log once it is this old, 0 disables
+	RotateEvery time.Duration
+	// Compress gzips rotated logs in the background
+	Compress bool
+	// Keep only keeps the newest Keep rotated logs, 0 keeps everything
+	Keep            int64
+	Options         Options
+	StartTime       time.Time
+	Lines           int64
+	BytesWritten    int64
+	Rotations       int64
+	LogsCompressed  int64
+	BytesCompressed int64
+	CompressedBytes int64
+	LogsDeleted     int64
+	Errors          int64
+	WriteLatency    stats.Latency
+	RotateLatency   stats.Latency
+	CompressLatency stats.Latency
+	file            *syncedFile
+	opened          time.Time
+	rotated         []*rotatedLog
+	compressions    sync.WaitGroup
+	lastReport      time.Time
+	lastLines       int64
+}
+
+func (l *LogWriter) Stats() {
+	totalTime := time.Since(l.StartTime)
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+	fmt.Printf("Lines Written: %v (%.2f lines/sec, %v target), %v bytes\n", l.Lines, perSecond(l.Lines, totalTime), l.LinesPerSecond, l.BytesWritten)
+	fmt.Printf("Write Latency: %v\n", &l.WriteLatency)
+	fmt.Printf("Rotations: %v, Errors: %v\n", l.Rotations, l.Errors)
+	fmt.Printf("Rotate Latency: %v\n", &l.RotateLatency)
+
+	if l.Compress {
+		ratio := 0.0
+
+		if l.CompressedBytes > 0 {
+			ratio = float64(l.BytesCompressed) / float64(l.CompressedBytes)
+		}
+
+		fmt.Printf("Logs Compressed: %v (%v bytes to %v, %.2f:1)\n", l.LogsCompressed, l.BytesCompressed, l.CompressedBytes, ratio)
+		fmt.Printf("Compress Latency: %v\n", &l.CompressLatency)
+	}
+
+	if l.Keep > 0 {
+		fmt.Printf("Logs Deleted: %v\n", l.LogsDeleted)
+	}
+
+	cacheStats()
+}
+
+func (l *LogWriter) Run() error {
+	if l.LinesPerSecond <= 0 || l.LineSizes.Min <= 0 || l.LineSizes.Max < l.LineSizes.Min {
+		return fmt.Errorf("need a positive line rate and 0 < min line size <= max line size")
+	}
+
+	if l.LineSizes.Kind == "" {
+		l.LineSizes.Kind = SizeUniform
+	}
+
+	if err := l.LineSizes.Init(); err != nil {
+		return err
+	}
+
+	if l.Options.Durability == DurabilityDirect {
+		return fmt.Errorf("log lines can't be written with O_DIRECT, they aren't aligned")
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	l.StartTime = time.Now()
+	l.lastReport = l.StartTime
+
+	results := make(chan *compressResult)
+	lines := NewLimiter(0, l.LinesPerSecond)
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	line := make([]byte, l.LineSizes.Max)
+
+	defer l.close(results)
+
+	for {
+		select {
+		case <-l.Context.Done():
+			return nil
+		case result := <-results:
+			l.recordCompress(result)
+		case <-l.Ticker.C:
+			interval := time.Since(l.lastReport)
+			fmt.Printf("%.2f lines/sec, %v lines, %v bytes written, %v rotations\n", perSecond(l.Lines-l.lastLines, interval), l.Lines, l.BytesWritten, l.Rotations)
+			l.lastReport = time.Now()
+			l.lastLines = l.Lines
+		default:
+		}
+
+		size := l.LineSizes.Next()
+
+		if lines.Wait(l.Context, 1) != nil || l.Options.Limiter.Wait(l.Context, size) != nil {
+			return nil
+		}
+
+		body := l.line(line[:size], rng)
+		startTime := time.Now()
+		n, err := l.file.Write(body)
+		l.WriteLatency.Add(time.Since(startTime))
+		l.BytesWritten += int64(n)
+
+		if err != nil {
+			l.Errors++
+			return err
+		}
+
+		l.Lines++
+
+		if (l.RotateSize > 0 && l.file.Written >= l.RotateSize) || (l.RotateEvery > 0 && time.Since(l.opened) >= l.RotateEvery) {
+			if err := l.rotate(results); err != nil {
+				l.Errors++
+				return err
+			}
+		}
+	}
+}
+
+// line fills body with a timestamped log line ending in a newline
+func (l *LogWriter) line(body []byte, rng *rand.Rand) []byte {
+	header := fmt.Sprintf("%v INFO troll seq=%v ", time.Now().UTC().Format(time.RFC3339Nano), l.Lines)
+	n := copy(body, header)
+	fillText(body[n:], rng)
+
+	for i := n; i < len(body)-1; i++ {
+		if body[i] == '\n' {
+			body[i] = ' '
+		}
+	}
+
+	body[len(body)-1] = '\n'
+
+	return body
+}
+
+func (l *LogWriter) open() error {
+	file, err := createFile(path.Join(l.RootPath, LogName), l.Options)
+
+	if err != nil {
+		return err
+	}
+
+	l.file = file
+	l.opened = time.Now()
+
+	return nil
+}
+
+// rotate renames the active log out of the way and starts a new one
+func (l *LogWriter) rotate(results chan<- *compressResult) error {
+	startTime := time.Now()
+
+	err := l.file.Close()
+	// Don't close it again on the way out if anything below fails
+	l.file = nil
+
+	if err != nil {
+		return err
+	}
+
+	l.Rotations++
+	rotated := path.Join(l.RootPath, fmt.Sprintf("%v.%v", LogName, l.Rotations))
+
+	if err := os.Rename(path.Join(l.RootPath, LogName), rotated); err != nil {
+		return err
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	l.RotateLatency.Add(time.Since(startTime))
+
+	log := &rotatedLog{path: rotated, compressing: l.Compress}
+	l.rotated = append(l.rotated, log)
+
+	if l.Compress {
+		l.compressions.Add(1)
+		go func() {
+			defer l.compressions.Done()
+			results <- compressLog(rotated)
+		}()
+	}
+
+	l.prune()
+
+	return nil
+}
+
+// prune deletes the oldest rotated logs past Keep, logs still being
+// compressed are left for the next rotation
+func (l *LogWriter) prune() {
+	for l.Keep > 0 && int64(len(l.rotated)) > l.Keep && !l.rotated[0].compressing {
+		if err := os.Remove(l.rotated[0].path); err != nil {
+			l.Errors++
+			fmt.Printf("Unable to delete %v: %v\n", l.rotated[0].path, err)
+		} else {
+			l.LogsDeleted++
+		}
+
+		l.rotated = l.rotated[1:]
+	}
+}
+
+func (l *LogWriter) recordCompress(result *compressResult) {
+	for _, log := range l.rotated {
+		if log.path == result.Path {
+			log.compressing = false
+
+			if result.Error == nil {
+				log.path += ".gz"
+			}
+		}
+	}
+
+	if result.Error != nil {
+		l.Errors++
+		fmt.Printf("Unable to compress %v: %v\n", result.Path, result.Error)
+		return
+	}
+
+	l.LogsCompressed++
+	l.BytesCompressed += result.Before
+	l.CompressedBytes += result.After
+	l.CompressLatency.Add(result.Duration)
+	l.prune()
+}
+
+// close waits for outstanding compressions and closes the active log,
+// deleting everything when DeleteOnExit is set
+func (l *LogWriter) close(results chan *compressResult) {
+	go func() {
+		l.compressions.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		l.recordCompress(result)
+	}
+
+	if l.file != nil && l.file.Close() != nil {
+		l.Errors++
+	}
+
+	if !l.Options.Retention.DeleteOnExit {
+		return
+	}
+
+	os.Remove(path.Join(l.RootPath, LogName))
+
+	for _, log := range l.rotated {
+		os.Remove(log.path)
+	}
+}
+
+// compressLog gzips name into name.gz and removes name
+func compressLog(name string) *compressResult {
+	startTime := time.Now()
+	result := &compressResult{Path: name}
+
+	source, err := os.Open(name)
+
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	defer source.Close()
+
+	target, err := os.Create(name + ".gz")
+
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	writer := gzip.NewWriter(target)
+	result.Before, err = io.Copy(writer, source)
+
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err == nil {
+		err = target.Sync()
+	}
+
+	if info, statErr := target.Stat(); statErr == nil {
+		result.After = info.Size()
+	}
+
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Remove(name)
+	}
+
+	result.Error = err
+	result.Duration = time.Since(startTime)
+
+	return result
+}
@@ -0,0 +1,359 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+const (
+	OpCreate  = "create"
+	OpMkdir   = "mkdir"
+	OpStat    = "stat"
+	OpList    = "list"
+	OpRename  = "rename"
+	OpChmod   = "chmod"
+	OpLink    = "link"
+	OpSymlink = "symlink"
+	OpUnlink  = "unlink"
+)
+
+// MetadataOps are all the operations the metadata replicator knows about
+var MetadataOps = []string{OpCreate, OpMkdir, OpStat, OpList, OpRename, OpChmod, OpLink, OpSymlink, OpUnlink}
+
+type MetadataResult struct {
+	Op       string
+	Path     string
+	Error    error
+	Duration time.Duration
+	op       metadataOp
+}
+
+// MetadataReplicator hammers the filesystem with metadata operations on a
+// tree of Depth levels of Width directories under RootPath
+type MetadataReplicator struct {
+	Context        context.Context
+	Ticker         *time.Ticker
+	RootPath       string
+	MaxWorkers     int64
+	CurrentWorkers int64
+	Depth          int64
+	Width          int64
+	Operations     []string
+	Options        Options
+	StartTime      time.Time
+	TotalOps       int64
+	OpLatency      map[string]*stats.Latency
+	OpErrors       map[string]int64
+	root           string
+	dirs           []string
+	files          []string
+	symlinks       map[string]bool
+	workers        sync.WaitGroup
+}
+
+// ValidMetadataOp reports whether op is a metadata operation
+func ValidMetadataOp(op string) bool {
+	for _, known := range MetadataOps {
+		if op == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *MetadataReplicator) Stats() {
+	totalTime := time.Since(r.StartTime)
+	errors := int64(0)
+
+	for _, count := range r.OpErrors {
+		errors += count
+	}
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+	fmt.Printf("Max Concurrency %v\n", r.MaxWorkers)
+	fmt.Printf("Tree: %v directories (depth %v, width %v), %v entries left\n", len(r.dirs), r.Depth, r.Width, len(r.files))
+	fmt.Printf("Total Operations: %v (%v errors), %.2f ops/sec\n", r.TotalOps, errors, perSecond(r.TotalOps, totalTime))
+
+	ops := make([]string, 0, len(r.OpLatency))
+
+	for op := range r.OpLatency {
+		ops = append(ops, op)
+	}
+
+	sort.Strings(ops)
+
+	for _, op := range ops {
+		fmt.Printf("\t%v: %v ops, %v errors, %v\n", op, r.OpLatency[op].Count(), r.OpErrors[op], r.OpLatency[op])
+	}
+}
+
+func (r *MetadataReplicator) Run() error {
+	r.StartTime = time.Now()
+	r.OpLatency = make(map[string]*stats.Latency)
+	r.OpErrors = make(map[string]int64)
+	r.symlinks = make(map[string]bool)
+
+	if len(r.Operations) == 0 {
+		r.Operations = MetadataOps
+	}
+
+	if err := r.buildTree(); err != nil {
+		return err
+	}
+
+	results := make(chan *MetadataResult, r.MaxWorkers)
+
+	// Cleanup removes the tree, so every operation has to be done with it first
+	defer r.workers.Wait()
+
+	for {
+		select {
+		case <-r.Context.Done():
+			return nil
+		case result := <-results:
+			r.record(result)
+			r.CurrentWorkers--
+		case <-r.Ticker.C:
+			for r.MaxWorkers > r.CurrentWorkers {
+				r.workers.Add(1)
+				go func(op metadataOp) {
+					defer r.workers.Done()
+					r.execute(op, results)
+				}(r.next())
+				r.CurrentWorkers++
+			}
+		}
+	}
+}
+
+func (r *MetadataReplicator) record(result *MetadataResult) {
+	r.TotalOps++
+	r.settle(result.op, result.Error == nil)
+
+	if _, ok := r.OpLatency[result.Op]; !ok {
+		r.OpLatency[result.Op] = &stats.Latency{}
+	}
+
+	if result.Error != nil {
+		fmt.Printf("%v %v failed: %v\n", result.Op, result.Path, result.Error)
+		r.OpErrors[result.Op]++
+		return
+	}
+
+	r.OpLatency[result.Op].Add(result.Duration)
+}
+
+// buildTree creates the directory tree every operation works inside of
+func (r *MetadataReplicator) buildTree() error {
+	id, err := uuid.NewRandom()
+
+	if err != nil {
+		return err
+	}
+
+	r.root = path.Join(r.RootPath, "troll-meta-"+id.String())
+	r.dirs = []string{r.root}
+	level := []string{r.root}
+
+	if err := r.mkdir(r.root); err != nil {
+		return err
+	}
+
+	for depth := int64(0); depth < r.Depth; depth++ {
+		next := make([]string, 0, int64(len(level))*r.Width)
+
+		for _, parent := range level {
+			for i := int64(0); i < r.Width; i++ {
+				dir := path.Join(parent, fmt.Sprintf("d%v", i))
+
+				if err := r.mkdir(dir); err != nil {
+					return err
+				}
+
+				next = append(next, dir)
+			}
+		}
+
+		r.dirs = append(r.dirs, next...)
+		level = next
+	}
+
+	fmt.Printf("Created %v directories under %v\n", len(r.dirs), r.root)
+
+	return nil
+}
+
+func (r *MetadataReplicator) mkdir(dir string) error {
+	startTime := time.Now()
+	err := os.Mkdir(dir, 0755)
+	r.record(&MetadataResult{Op: OpMkdir, Path: dir, Error: err, Duration: time.Since(startTime)})
+
+	return err
+}
+
+// metadataOp is an operation picked by the Run loop. Its source is taken out
+// of the known files while it runs so no two operations race on one entry
+type metadataOp struct {
+	op      string
+	source  string
+	target  string
+	symlink bool
+}
+
+func (r *MetadataReplicator) newName() string {
+	return path.Join(r.dirs[rand.Intn(len(r.dirs))], fmt.Sprintf("f%v", rand.Int63()))
+}
+
+// takeFile removes a random entry from the known files
+func (r *MetadataReplicator) takeFile() (string, bool) {
+	i := rand.Intn(len(r.files))
+	file := r.files[i]
+	r.files[i] = r.files[len(r.files)-1]
+	r.files = r.files[:len(r.files)-1]
+
+	symlink := r.symlinks[file]
+	delete(r.symlinks, file)
+
+	return file, symlink
+}
+
+func (r *MetadataReplicator) addFile(file string, symlink bool) {
+	r.files = append(r.files, file)
+
+	if symlink {
+		r.symlinks[file] = true
+	}
+}
+
+func (r *MetadataReplicator) next() metadataOp {
+	op := r.Operations[rand.Intn(len(r.Operations))]
+
+	if len(r.files) == 0 && op != OpList && op != OpCreate && op != OpMkdir {
+		op = OpCreate
+	}
+
+	switch op {
+	case OpCreate, OpMkdir:
+		return metadataOp{op: op, target: r.newName()}
+	case OpList:
+		return metadataOp{op: op, source: r.dirs[rand.Intn(len(r.dirs))]}
+	}
+
+	source, symlink := r.takeFile()
+
+	if op == OpChmod && symlink {
+		// chmod follows symlinks, which may well be dangling by now
+		op = OpStat
+	}
+
+	next := metadataOp{op: op, source: source, symlink: symlink}
+
+	switch op {
+	case OpRename, OpLink, OpSymlink:
+		next.target = r.newName()
+	}
+
+	return next
+}
+
+// settle puts the entries an operation leaves behind back into the known files
+func (r *MetadataReplicator) settle(op metadataOp, ok bool) {
+	switch op.op {
+	case OpCreate:
+		if ok {
+			r.addFile(op.target, false)
+		}
+	case OpMkdir:
+		if ok {
+			// New directories take new entries like the rest of the tree
+			r.dirs = append(r.dirs, op.target)
+		}
+	case OpStat, OpChmod:
+		if ok {
+			r.addFile(op.source, op.symlink)
+		}
+	case OpRename:
+		if ok {
+			r.addFile(op.target, op.symlink)
+		} else {
+			r.addFile(op.source, op.symlink)
+		}
+	case OpLink, OpSymlink:
+		r.addFile(op.source, op.symlink)
+
+		if ok {
+			r.addFile(op.target, op.op == OpSymlink || op.symlink)
+		}
+	}
+}
+
+func (r *MetadataReplicator) execute(op metadataOp, results chan<- *MetadataResult) {
+	var err error
+
+	startTime := time.Now()
+
+	switch op.op {
+	case OpCreate:
+		var file *os.File
+		file, err = os.OpenFile(op.target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = file.Close()
+		}
+	case OpMkdir:
+		err = os.Mkdir(op.target, 0755)
+	case OpStat:
+		_, err = os.Lstat(op.source)
+	case OpList:
+		_, err = ioutil.ReadDir(op.source)
+	case OpRename:
+		err = os.Rename(op.source, op.target)
+	case OpChmod:
+		err = os.Chmod(op.source, os.FileMode(0600+rand.Intn(2)*044))
+	case OpLink:
+		err = os.Link(op.source, op.target)
+	case OpSymlink:
+		err = os.Symlink(op.source, op.target)
+	case OpUnlink:
+		err = os.Remove(op.source)
+	}
+
+	duration := time.Since(startTime)
+	path := op.source
+
+	if path == "" {
+		path = op.target
+	}
+
+	select {
+	case results <- &MetadataResult{Op: op.op, Path: path, Error: err, Duration: duration, op: op}:
+	case <-r.Context.Done():
+	}
+}
+
+// Cleanup removes the whole tree when DeleteOnExit is set
+func (r *MetadataReplicator) Cleanup() {
+	if !r.Options.Retention.DeleteOnExit || r.root == "" {
+		return
+	}
+
+	fmt.Printf("Deleting %v\n", r.root)
+
+	if err := os.RemoveAll(r.root); err != nil {
+		fmt.Printf("Unable to delete %v: %v\n", r.root, err)
+	}
+}
@@ -0,0 +1,217 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+// mmapCheckEvery is how many pages are touched between checks of the context and ticker
+const mmapCheckEvery = 256
+
+// MmapReplicator maps a Size byte file and touches its pages following one of
+// the io Patterns, reads load a byte of the page and writes dirty it. With a
+// sync policy in Options dirty pages are msynced every SyncEvery bytes, or
+// after each pass over the file
+type MmapReplicator struct {
+	Context     context.Context
+	Ticker      *time.Ticker
+	Path        string
+	Size        int64
+	Pattern     string
+	ReadPercent int64
+	Options     Options
+	StartTime   time.Time
+	PageSize    int64
+	PagesRead   int64
+	PagesDirty  int64
+	Msyncs      int64
+	Errors      int64
+	// MinorFaults and MajorFaults are counted for the whole process during the run
+	MinorFaults  int64
+	MajorFaults  int64
+	MsyncLatency stats.Latency
+	data         []byte
+	next         int64
+	unsynced     int64
+	sink         byte
+	startMinor   int64
+	startMajor   int64
+	lastReport   time.Time
+	lastPages    int64
+	lastMinor    int64
+	lastMajor    int64
+}
+
+func (m *MmapReplicator) Stats() {
+	totalTime := time.Since(m.StartTime)
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+	fmt.Printf("Pattern: %v, File: %v bytes (%v pages of %v)\n", m.Pattern, m.Size, m.Size/m.PageSize, m.PageSize)
+	fmt.Printf("Pages Read: %v (%.2f/sec), Pages Dirtied: %v (%.2f/sec, %.2f MB/s)\n", m.PagesRead, perSecond(m.PagesRead, totalTime), m.PagesDirty, perSecond(m.PagesDirty, totalTime), perSecond(m.PagesDirty*m.PageSize, totalTime)/1e6)
+	fmt.Printf("Page Faults: %v minor (%.2f/sec), %v major (%.2f/sec)\n", m.MinorFaults, perSecond(m.MinorFaults, totalTime), m.MajorFaults, perSecond(m.MajorFaults, totalTime))
+	fmt.Printf("Errors: %v\n", m.Errors)
+
+	if m.Options.syncs() {
+		fmt.Printf("Msyncs: %v\n", m.Msyncs)
+		fmt.Printf("Msync Latency: %v\n", &m.MsyncLatency)
+	}
+
+	cacheStats()
+}
+
+func (m *MmapReplicator) Run() error {
+	m.PageSize = int64(os.Getpagesize())
+
+	if m.Size%m.PageSize != 0 {
+		m.Size += m.PageSize - m.Size%m.PageSize
+	}
+
+	if m.Size <= 0 {
+		return fmt.Errorf("the file needs at least one page")
+	}
+
+	file, err := os.OpenFile(m.Path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if m.Options.Retention.DeleteOnExit {
+		defer os.Remove(m.Path)
+	}
+
+	if err := file.Truncate(m.Size); err != nil {
+		return err
+	}
+
+	m.data, err = mmap(file, m.Size)
+
+	if err != nil {
+		return err
+	}
+
+	defer munmap(m.data)
+
+	m.StartTime = time.Now()
+	m.lastReport = m.StartTime
+	m.startMinor, m.startMajor, err = pageFaults()
+
+	if err != nil {
+		return err
+	}
+
+	defer m.faults()
+
+	pages := m.Size / m.PageSize
+
+	for {
+		for i := 0; i < mmapCheckEvery; i++ {
+			if err := m.touch(pages); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-m.Context.Done():
+			return m.sync()
+		case <-m.Ticker.C:
+			m.faults()
+			interval := time.Since(m.lastReport)
+			pagesTouched := m.PagesRead + m.PagesDirty
+			fmt.Printf("%.2f pages/sec, %.2f minor faults/sec, %.2f major faults/sec\n", perSecond(pagesTouched-m.lastPages, interval), perSecond(m.MinorFaults-m.lastMinor, interval), perSecond(m.MajorFaults-m.lastMajor, interval))
+			m.lastReport = time.Now()
+			m.lastPages = pagesTouched
+			m.lastMinor = m.MinorFaults
+			m.lastMajor = m.MajorFaults
+		default:
+		}
+	}
+}
+
+// touch reads or dirties the next page the pattern picks
+func (m *MmapReplicator) touch(pages int64) error {
+	page := m.next
+
+	switch m.Pattern {
+	case PatternRandRead, PatternRandWrite, PatternRandRW:
+		page = rand.Int63n(pages)
+	default:
+		m.next = (m.next + 1) % pages
+	}
+
+	read := false
+
+	switch m.Pattern {
+	case PatternRead, PatternRandRead:
+		read = true
+	case PatternReadWrite, PatternRandRW:
+		read = rand.Int63n(100) < m.ReadPercent
+	}
+
+	if err := m.Options.Limiter.Wait(m.Context, m.PageSize); err != nil {
+		return nil
+	}
+
+	offset := page * m.PageSize
+
+	if read {
+		m.sink += m.data[offset]
+		m.PagesRead++
+		return nil
+	}
+
+	m.data[offset]++
+	m.PagesDirty++
+	m.unsynced += m.PageSize
+
+	if !m.Options.syncs() {
+		return nil
+	}
+
+	if (m.Options.SyncEvery > 0 && m.unsynced >= m.Options.SyncEvery) || (m.Options.SyncEvery == 0 && m.unsynced >= m.Size) {
+		return m.sync()
+	}
+
+	return nil
+}
+
+// sync msyncs the mapping when the options ask for it
+func (m *MmapReplicator) sync() error {
+	if !m.Options.syncs() || m.unsynced == 0 {
+		return nil
+	}
+
+	startTime := time.Now()
+	err := msync(m.data)
+	m.MsyncLatency.Add(time.Since(startTime))
+	m.Msyncs++
+	m.unsynced = 0
+
+	if err != nil {
+		m.Errors++
+	}
+
+	return err
+}
+
+func (m *MmapReplicator) faults() {
+	minor, major, err := pageFaults()
+
+	if err != nil {
+		m.Errors++
+		return
+	}
+
+	m.MinorFaults = minor - m.startMinor
+	m.MajorFaults = major - m.startMajor
+}
@@ -0,0 +1,186 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+// Durability controls what it takes for a write to count as done
+const (
+	// DurabilityNone leaves data in the page cache
+	DurabilityNone = "none"
+	// DurabilityFsync calls fsync once a file is finished (or every SyncEvery bytes)
+	DurabilityFsync = "fsync"
+	// DurabilityFdatasync is DurabilityFsync using fdatasync instead
+	DurabilityFdatasync = "fdatasync"
+	// DurabilityDirect opens files with O_DIRECT, bypassing the page cache
+	DurabilityDirect = "direct"
+	// DurabilitySync opens files with O_SYNC
+	DurabilitySync = "osync"
+	// DurabilityDataSync opens files with O_DSYNC
+	DurabilityDataSync = "odsync"
+)
+
+// Alignment is the buffer and size alignment used for O_DIRECT
+const Alignment = 4096
+
+var errNotSupported = fmt.Errorf("not supported on this platform")
+
+// Options tunes how the files subsystem writes data
+type Options struct {
+	Durability string
+	// SyncEvery syncs after this many bytes have been written to a file,
+	// 0 only syncs once the file is finished
+	SyncEvery int64
+	Retention Retention
+	// Data generates the bytes written
+	Data Generator
+	// Limiter caps write throughput and IOPS, nil writes as fast as possible
+	Limiter *Limiter
+	// Cache is the page cache policy, one of the Cache policies
+	Cache string
+}
+
+// ValidDurability reports whether durability is one of the supported modes
+func ValidDurability(durability string) bool {
+	switch durability {
+	case DurabilityNone, DurabilityFsync, DurabilityFdatasync, DurabilityDirect, DurabilitySync, DurabilityDataSync:
+		return true
+	}
+
+	return false
+}
+
+// syncs reports whether the options call for explicit syncs
+func (o Options) syncs() bool {
+	return o.Durability == DurabilityFsync || o.Durability == DurabilityFdatasync || o.SyncEvery > 0
+}
+
+// alignSize rounds size up to what the durability mode can write
+func (o Options) alignSize(size int64) int64 {
+	if o.Durability != DurabilityDirect || size%Alignment == 0 {
+		return size
+	}
+
+	return size + Alignment - size%Alignment
+}
+
+// buffer allocates a buffer suitable for the durability mode, O_DIRECT needs
+// both the address and length aligned
+func (o Options) buffer(size int64) []byte {
+	if o.Durability != DurabilityDirect {
+		return make([]byte, size)
+	}
+
+	size = o.alignSize(size)
+	raw := make([]byte, size+Alignment)
+	offset := int64(0)
+
+	if remainder := int64(uintptr(unsafe.Pointer(&raw[0])) % Alignment); remainder != 0 {
+		offset = Alignment - remainder
+	}
+
+	return raw[offset : offset+size]
+}
+
+// syncedFile writes to a file honoring Options, timing writes and syncs separately
+type syncedFile struct {
+	file         *os.File
+	options      Options
+	unsynced     int64
+	Written      int64
+	WriteTime    time.Duration
+	SyncTime     time.Duration
+	WriteLatency stats.Latency
+	SyncLatency  stats.Latency
+}
+
+// openFlags returns the open flags the durability mode needs
+func openFlags(options Options) (int, error) {
+	switch options.Durability {
+	case DurabilityDirect:
+		if oDirect == 0 {
+			return 0, fmt.Errorf("O_DIRECT is not supported on this platform")
+		}
+		return oDirect, nil
+	case DurabilitySync:
+		return os.O_SYNC, nil
+	case DurabilityDataSync:
+		return oDsync, nil
+	}
+
+	return 0, nil
+}
+
+func createFile(path string, options Options) (*syncedFile, error) {
+	flags, err := openFlags(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, flags|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncedFile{file: file, options: options}, nil
+}
+
+func (s *syncedFile) Write(p []byte) (int, error) {
+	startTime := time.Now()
+	n, err := s.file.Write(p)
+	duration := time.Since(startTime)
+
+	s.WriteTime += duration
+	s.WriteLatency.Add(duration)
+	s.Written += int64(n)
+	s.unsynced += int64(n)
+
+	if err != nil {
+		return n, err
+	}
+
+	if s.options.SyncEvery > 0 && s.unsynced >= s.options.SyncEvery {
+		return n, s.Sync()
+	}
+
+	return n, nil
+}
+
+// Sync flushes the file using fdatasync or fsync depending on the options
+func (s *syncedFile) Sync() error {
+	startTime := time.Now()
+
+	var err error
+
+	if s.options.Durability == DurabilityFdatasync {
+		err = fdatasync(s.file)
+	} else {
+		err = s.file.Sync()
+	}
+
+	duration := time.Since(startTime)
+	s.SyncTime += duration
+	s.SyncLatency.Add(duration)
+	s.unsynced = 0
+
+	return err
+}
+
+// Close syncs anything still outstanding when the options ask for it
+func (s *syncedFile) Close() error {
+	if s.unsynced > 0 && s.options.syncs() {
+		if err := s.Sync(); err != nil {
+			s.file.Close()
+			return err
+		}
+	}
+
+	return s.file.Close()
+}
@@ -0,0 +1,319 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// ballastFileSize caps each ballast file so space can be handed back in pieces
+	ballastFileSize = 1 << 30
+	// maxTimeline is roughly how many samples the final timeline shows
+	maxTimeline = 60
+)
+
+type diskSample struct {
+	Time      time.Time
+	Available uint64
+	Used      float64
+}
+
+// DiskPressure fills the filesystem under RootPath with ballast files until
+// a target is reached, holds it there and then gives the space back
+type DiskPressure struct {
+	Context context.Context
+	Ticker  *time.Ticker
+	// RootPath is where the ballast files are created
+	RootPath string
+	// TargetPercent is the used percentage to fill the filesystem to
+	TargetPercent float64
+	// TargetFree is the number of bytes to leave available, it wins over TargetPercent
+	TargetFree int64
+	// HoldTime is how long to hold the target once reached, 0 holds until exit
+	HoldTime time.Duration
+	// Oscillation frees this many bytes every other tick while holding
+	Oscillation int64
+	// UseWrites fills with writes instead of fallocate
+	UseWrites    bool
+	StartTime    time.Time
+	ReachedTime  time.Duration
+	BytesFilled  int64
+	Errors       int64
+	ballast      []string
+	ballastSizes []int64
+	samples      []diskSample
+	full         bool
+	chunk        []byte
+}
+
+func (d *DiskPressure) Stats() {
+	totalTime := time.Since(d.StartTime)
+
+	fmt.Println(strings.Repeat("\n", 2))
+	fmt.Println("Final Stats:")
+	fmt.Printf("Total Run Duration %v\n", totalTime)
+
+	if d.ReachedTime > 0 {
+		fmt.Printf("Time To Reach Target: %v\n", d.ReachedTime)
+	} else {
+		fmt.Println("Target was never reached")
+	}
+
+	fmt.Printf("Bytes Filled: %v, Errors: %v\n", d.BytesFilled, d.Errors)
+
+	if len(d.samples) == 0 {
+		return
+	}
+
+	fmt.Println("Free Space Timeline:")
+
+	// Thin the timeline out so long runs stay readable
+	step := len(d.samples)/maxTimeline + 1
+
+	for i, sample := range d.samples {
+		if i%step != 0 && i != len(d.samples)-1 {
+			continue
+		}
+
+		fmt.Printf("\t%v\t%v bytes available\t%.2f%% used\n", sample.Time.Sub(d.StartTime).Truncate(time.Millisecond), sample.Available, sample.Used)
+	}
+}
+
+func (d *DiskPressure) Run() error {
+	d.StartTime = time.Now()
+	d.chunk = make([]byte, 1<<20)
+	rand.Read(d.chunk)
+
+	defer d.release()
+
+	var holdStart time.Time
+	oscillating := false
+
+	for {
+		usage, err := statfs(d.RootPath)
+
+		if err != nil {
+			return err
+		}
+
+		d.samples = append(d.samples, diskSample{Time: time.Now(), Available: usage.Available, Used: usage.UsedPercent()})
+		fmt.Printf("%v bytes available, %.2f%% used, %v bytes of ballast\n", usage.Available, usage.UsedPercent(), d.ballastTotal())
+
+		target := d.targetAvailable(usage)
+
+		if oscillating {
+			target += uint64(d.Oscillation)
+		}
+
+		switch {
+		case usage.Available > target && !d.full:
+			if err := d.fill(int64(usage.Available - target)); isNoSpace(err) {
+				// Available counts space the filesystem won't hand out, there is no more to take
+				fmt.Println("The filesystem filled up before reaching the target")
+				d.full = true
+			} else if err != nil {
+				d.Errors++
+				fmt.Printf("Unable to fill: %v\n", err)
+			}
+		case usage.Available < target:
+			d.shrink(int64(target - usage.Available))
+		}
+
+		if d.ReachedTime == 0 && !oscillating {
+			if after, err := statfs(d.RootPath); err == nil && (d.full || after.Available <= d.targetAvailable(after)) {
+				d.ReachedTime = time.Since(d.StartTime)
+				holdStart = time.Now()
+				fmt.Printf("Reached target after %v\n", d.ReachedTime)
+			}
+		}
+
+		if d.ReachedTime > 0 && d.Oscillation > 0 {
+			oscillating = !oscillating
+		}
+
+		if d.ReachedTime > 0 && d.HoldTime > 0 && time.Since(holdStart) >= d.HoldTime {
+			fmt.Printf("Held target for %v, releasing\n", d.HoldTime)
+			return nil
+		}
+
+		select {
+		case <-d.Context.Done():
+			return nil
+		case <-d.Ticker.C:
+		}
+	}
+}
+
+// targetAvailable turns the configured target into bytes that should stay available
+func (d *DiskPressure) targetAvailable(usage diskUsage) uint64 {
+	if d.TargetFree > 0 {
+		return uint64(d.TargetFree)
+	}
+
+	capacity := usage.Total - usage.Free + usage.Available
+
+	return uint64(float64(capacity) * (100 - d.TargetPercent) / 100)
+}
+
+func (d *DiskPressure) ballastTotal() int64 {
+	total := int64(0)
+
+	for _, size := range d.ballastSizes {
+		total += size
+	}
+
+	return total
+}
+
+// fill grows the ballast by size bytes, a full disk stops it early
+func (d *DiskPressure) fill(size int64) error {
+	for size > 0 {
+		last := len(d.ballast) - 1
+
+		if last < 0 || d.ballastSizes[last] >= ballastFileSize {
+			d.ballast = append(d.ballast, path.Join(d.RootPath, fmt.Sprintf("troll-ballast-%v", len(d.ballast))))
+			d.ballastSizes = append(d.ballastSizes, 0)
+			last++
+		}
+
+		grow := ballastFileSize - d.ballastSizes[last]
+
+		if grow > size {
+			grow = size
+		}
+
+		grown, err := d.grow(d.ballast[last], d.ballastSizes[last], grow)
+		d.ballastSizes[last] += grown
+		d.BytesFilled += grown
+		size -= grown
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DiskPressure) grow(name string, offset, size int64) (int64, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+
+	if offset == 0 {
+		// A ballast file left behind by an earlier run would throw the sizes off
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(name, flags, 0644)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	if !d.UseWrites {
+		err := fallocate(file, offset, size)
+
+		if err == nil {
+			return size, nil
+		}
+
+		if !isNotSupported(err) {
+			return d.allocated(file, offset), err
+		}
+
+		fmt.Println("fallocate is not supported here, falling back to writes")
+		d.UseWrites = true
+	}
+
+	written := int64(0)
+
+	for written < size {
+		if err := d.Context.Err(); err != nil {
+			return written, err
+		}
+
+		chunk := d.chunk
+
+		if remaining := size - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := file.WriteAt(chunk, offset+written)
+		written += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, file.Sync()
+}
+
+// allocated is how far a failed fallocate got past offset, it can extend the
+// file part of the way before giving up
+func (d *DiskPressure) allocated(file *os.File, offset int64) int64 {
+	info, err := file.Stat()
+
+	if err != nil || info.Size() < offset {
+		return 0
+	}
+
+	return info.Size() - offset
+}
+
+// shrink hands size bytes back, newest ballast first
+func (d *DiskPressure) shrink(size int64) {
+	for size > 0 && len(d.ballast) > 0 {
+		last := len(d.ballast) - 1
+
+		if d.ballastSizes[last] <= size {
+			if err := os.Remove(d.ballast[last]); err != nil {
+				d.Errors++
+				fmt.Printf("Unable to delete %v: %v\n", d.ballast[last], err)
+				return
+			}
+
+			size -= d.ballastSizes[last]
+			d.ballast = d.ballast[:last]
+			d.ballastSizes = d.ballastSizes[:last]
+			continue
+		}
+
+		if err := os.Truncate(d.ballast[last], d.ballastSizes[last]-size); err != nil {
+			d.Errors++
+			fmt.Printf("Unable to truncate %v: %v\n", d.ballast[last], err)
+			return
+		}
+
+		d.ballastSizes[last] -= size
+		size = 0
+	}
+
+	// The space given back can be taken again
+	d.full = false
+}
+
+// release deletes every ballast file and records the space coming back
+func (d *DiskPressure) release() {
+	fmt.Printf("Releasing %v bytes of ballast\n", d.ballastTotal())
+
+	for _, name := range d.ballast {
+		if err := os.Remove(name); err != nil {
+			d.Errors++
+			fmt.Printf("Unable to delete %v: %v\n", name, err)
+		}
+	}
+
+	d.ballast = nil
+	d.ballastSizes = nil
+
+	if usage, err := statfs(d.RootPath); err == nil {
+		d.samples = append(d.samples, diskSample{Time: time.Now(), Available: usage.Available, Used: usage.UsedPercent()})
+	}
+}
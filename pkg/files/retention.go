@@ -0,0 +1,158 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Retention bounds how much a run leaves behind on disk, zero values disable
+// each limit
+type Retention struct {
+	// DeleteOnExit removes every file written once the run is over
+	DeleteOnExit bool
+	// KeepFiles only keeps the newest KeepFiles files, deleting older ones
+	KeepFiles int64
+	// MaxBytes deletes the oldest files (or rewinds a single file) to stay under MaxBytes
+	MaxBytes int64
+	// MaxDiskUsage stops writing once the filesystem is this percent full
+	MaxDiskUsage float64
+}
+
+func (r Retention) enabled() bool {
+	return r.DeleteOnExit || r.KeepFiles > 0 || r.MaxBytes > 0
+}
+
+type diskUsage struct {
+	Total      uint64
+	Free       uint64
+	Available  uint64
+	Inodes     uint64
+	FreeInodes uint64
+}
+
+// UsedPercent matches what df reports, reserved blocks count as unavailable
+func (d diskUsage) UsedPercent() float64 {
+	used := d.Total - d.Free
+
+	if used+d.Available == 0 {
+		return 0
+	}
+
+	return 100 * float64(used) / float64(used+d.Available)
+}
+
+// InodesUsedPercent is the percentage of inodes in use
+func (d diskUsage) InodesUsedPercent() float64 {
+	if d.Inodes == 0 {
+		return 0
+	}
+
+	return 100 * float64(d.Inodes-d.FreeInodes) / float64(d.Inodes)
+}
+
+// diskFull reports whether path's filesystem has reached the MaxDiskUsage target
+func (r Retention) diskFull(path string) (bool, float64, error) {
+	if r.MaxDiskUsage <= 0 {
+		return false, 0, nil
+	}
+
+	usage, err := statfs(path)
+
+	if err != nil {
+		return false, 0, err
+	}
+
+	return usage.UsedPercent() >= r.MaxDiskUsage, usage.UsedPercent(), nil
+}
+
+// track remembers a newly written file and deletes old files to honor the retention policy
+func (r *Replicator) track(file writtenFile) {
+	r.written = append(r.written, file)
+	r.liveBytes += file.Size
+
+	for len(r.written) > 0 {
+		retention := r.Options.Retention
+
+		if !(retention.KeepFiles > 0 && int64(len(r.written)) > retention.KeepFiles) &&
+			!(retention.MaxBytes > 0 && r.liveBytes > retention.MaxBytes) {
+			return
+		}
+
+		r.deleteOldest()
+	}
+}
+
+func (r *Replicator) deleteOldest() {
+	oldest := r.written[0]
+	r.written = r.written[1:]
+	r.liveBytes -= oldest.Size
+	r.dropSample(oldest.Path)
+
+	startTime := time.Now()
+	err := os.Remove(oldest.Path)
+	r.Stalls.Check("delete", oldest.Path, time.Since(startTime))
+
+	if err != nil {
+		fmt.Printf("Unable to delete %v: %v\n", oldest.Path, err)
+		return
+	}
+
+	r.FilesDeleted++
+	r.BytesDeleted += oldest.Size
+}
+
+// tracked reports whether path is still one of the files the replicator keeps,
+// only the retention policy deletes files so without one they all are
+func (r *Replicator) tracked(path string) bool {
+	if !r.Options.Retention.enabled() {
+		return true
+	}
+
+	for _, file := range r.written {
+		if file.Path == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cleanup deletes every file still on disk when DeleteOnExit is set, call it
+// after Run (and VerifyAll) have returned
+func (r *Replicator) Cleanup() {
+	if !r.Options.Retention.DeleteOnExit {
+		return
+	}
+
+	fmt.Printf("Deleting %v files\n", len(r.written)+len(r.pending))
+
+	for len(r.written) > 0 {
+		r.deleteOldest()
+	}
+
+	// Failed writes and the ones still going when the run ended
+	for path := range r.pending {
+		r.Options.Retention.Cleanup(path)
+		delete(r.pending, path)
+	}
+}
+
+// Cleanup deletes paths when DeleteOnExit is set, paths that were never
+// created or aren't regular files (like a -path left pointing at a directory)
+// are skipped
+func (r Retention) Cleanup(paths ...string) {
+	if !r.DeleteOnExit {
+		return
+	}
+
+	for _, path := range paths {
+		if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("Unable to delete %v: %v\n", path, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package files
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/alyssadaemon/troll/pkg/units"
+)
+
+// Size distributions pick how big each file is
+const (
+	// SizeFixed always picks Max
+	SizeFixed = "fixed"
+	// SizeUniform picks evenly between Min and Max
+	SizeUniform = "uniform"
+	// SizeNormal follows a normal distribution of Mean and StdDev
+	SizeNormal = "normal"
+	// SizeLognormal follows a lognormal distribution with the given Mean and StdDev
+	SizeLognormal = "lognormal"
+	// SizePareto follows a Pareto distribution starting at Min with a tail of Shape
+	SizePareto = "pareto"
+	// SizeEmpirical picks from a Histogram
+	SizeEmpirical = "empirical"
+)
+
+// SizeBucket is a histogram bucket holding sizes up to Upper, from the previous bucket's Upper
+type SizeBucket struct {
+	Upper  int64
+	Weight float64
+}
+
+// SizeDistribution picks file sizes, every size is clamped to [Min, Max]
+type SizeDistribution struct {
+	Kind   string
+	Min    int64
+	Max    int64
+	Mean   float64
+	StdDev float64
+	// Shape is the Pareto tail index, 1.16 gives the 80/20 rule
+	Shape     float64
+	Histogram []SizeBucket
+	total     float64
+}
+
+// ValidSizes reports whether kind is one of the supported size distributions
+func ValidSizes(kind string) bool {
+	switch kind {
+	case SizeFixed, SizeUniform, SizeNormal, SizeLognormal, SizePareto, SizeEmpirical:
+		return true
+	}
+
+	return false
+}
+
+// ReadHistogram loads an empirical size histogram, one "size weight" bucket
+// per line in increasing order of size. Sizes support b,k,m,g,t,p and lines
+// starting with # are ignored
+func ReadHistogram(path string) ([]SizeBucket, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []SizeBucket{}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected a size and a weight", path, i+1)
+		}
+
+		upper, err := units.ParseSize(fields[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, i+1, err)
+		}
+
+		weight, err := strconv.ParseFloat(fields[1], 64)
+
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%v:%v: invalid weight %v", path, i+1, fields[1])
+		}
+
+		if len(buckets) > 0 && upper <= buckets[len(buckets)-1].Upper {
+			return nil, fmt.Errorf("%v:%v: sizes must increase", path, i+1)
+		}
+
+		buckets = append(buckets, SizeBucket{Upper: upper, Weight: weight})
+	}
+
+	return buckets, nil
+}
+
+// Init checks the distribution and fills in defaults, the mean defaults to
+// halfway between Min and Max and the standard deviation to a sixth of the range
+func (d *SizeDistribution) Init() error {
+	if !ValidSizes(d.Kind) {
+		return fmt.Errorf("Unknown size distribution %v", d.Kind)
+	}
+
+	if d.Min < 0 || d.Max < d.Min {
+		return fmt.Errorf("need 0 <= min size %v <= max size %v", d.Min, d.Max)
+	}
+
+	if d.Mean <= 0 {
+		d.Mean = float64(d.Min+d.Max) / 2
+	}
+
+	if d.StdDev <= 0 {
+		d.StdDev = float64(d.Max-d.Min) / 6
+	}
+
+	if d.Shape <= 0 {
+		d.Shape = 1.16
+	}
+
+	if d.Kind != SizeEmpirical {
+		return nil
+	}
+
+	d.total = 0
+
+	for _, bucket := range d.Histogram {
+		d.total += bucket.Weight
+	}
+
+	if d.total <= 0 {
+		return fmt.Errorf("the size histogram is empty")
+	}
+
+	return nil
+}
+
+// Next picks the next size
+func (d *SizeDistribution) Next() int64 {
+	size := float64(d.Max)
+
+	switch d.Kind {
+	case SizeUniform:
+		return d.Min + rand.Int63n(d.Max-d.Min+1)
+	case SizeNormal:
+		size = rand.NormFloat64()*d.StdDev + d.Mean
+	case SizeLognormal:
+		// Turn the mean and standard deviation of the sizes into the
+		// parameters of the underlying normal distribution
+		sigma := math.Sqrt(math.Log(1 + (d.StdDev*d.StdDev)/(d.Mean*d.Mean)))
+		mu := math.Log(d.Mean) - sigma*sigma/2
+		size = math.Exp(rand.NormFloat64()*sigma + mu)
+	case SizePareto:
+		scale := math.Max(float64(d.Min), 1)
+		size = scale / math.Pow(1-rand.Float64(), 1/d.Shape)
+	case SizeEmpirical:
+		size = d.empirical()
+	}
+
+	return d.clamp(size)
+}
+
+func (d *SizeDistribution) empirical() float64 {
+	pick := rand.Float64() * d.total
+	lower := int64(0)
+
+	for _, bucket := range d.Histogram {
+		if pick < bucket.Weight {
+			return float64(lower) + rand.Float64()*float64(bucket.Upper-lower)
+		}
+
+		pick -= bucket.Weight
+		lower = bucket.Upper
+	}
+
+	return float64(lower)
+}
+
+func (d *SizeDistribution) clamp(size float64) int64 {
+	if size < float64(d.Min) || math.IsNaN(size) {
+		return d.Min
+	}
+
+	if size > float64(d.Max) {
+		return d.Max
+	}
+
+	return int64(size)
+}
@@ -0,0 +1,163 @@
+package files
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSizeDistributionInit(t *testing.T) {
+	tests := []struct {
+		name         string
+		distribution SizeDistribution
+		mean, stddev float64
+		err          bool
+	}{
+		{"defaults", SizeDistribution{Kind: SizeNormal, Min: 100, Max: 700}, 400, 100, false},
+		{"explicit", SizeDistribution{Kind: SizeLognormal, Max: 1000, Mean: 200, StdDev: 50}, 200, 50, false},
+		{"fixed", SizeDistribution{Kind: SizeFixed, Max: 10}, 5, 10.0 / 6, false},
+		{"unknown kind", SizeDistribution{Kind: "bimodal", Max: 10}, 0, 0, true},
+		{"negative min", SizeDistribution{Kind: SizeUniform, Min: -1, Max: 10}, 0, 0, true},
+		{"min over max", SizeDistribution{Kind: SizeUniform, Min: 20, Max: 10}, 0, 0, true},
+		{"empty histogram", SizeDistribution{Kind: SizeEmpirical, Max: 10}, 0, 0, true},
+		{"zero weight histogram", SizeDistribution{Kind: SizeEmpirical, Max: 10, Histogram: []SizeBucket{{10, 0}}}, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		d := test.distribution
+		err := d.Init()
+
+		if (err != nil) != test.err {
+			t.Errorf("%v: Init() error = %v, want error %v", test.name, err, test.err)
+			continue
+		}
+
+		if test.err {
+			continue
+		}
+
+		if d.Mean != test.mean || d.StdDev != test.stddev {
+			t.Errorf("%v: mean %v stddev %v, want %v and %v", test.name, d.Mean, d.StdDev, test.mean, test.stddev)
+		}
+	}
+}
+
+func TestSizeDistributionNext(t *testing.T) {
+	const samples = 20000
+
+	tests := []struct {
+		distribution SizeDistribution
+		// mean is the expected sample mean, within tolerance of it
+		mean, tolerance float64
+	}{
+		{SizeDistribution{Kind: SizeFixed, Min: 10, Max: 1000}, 1000, 0},
+		{SizeDistribution{Kind: SizeUniform, Min: 0, Max: 1000}, 500, 15},
+		{SizeDistribution{Kind: SizeUniform, Min: 7, Max: 7}, 7, 0},
+		{SizeDistribution{Kind: SizeNormal, Min: 0, Max: 1000, Mean: 500, StdDev: 100}, 500, 5},
+		{SizeDistribution{Kind: SizeLognormal, Min: 0, Max: 1 << 30, Mean: 4096, StdDev: 1024}, 4096, 50},
+		// Pareto with a shape of 3 has a mean of 1.5 times the scale
+		{SizeDistribution{Kind: SizePareto, Min: 1000, Max: 1 << 30, Shape: 3}, 1500, 50},
+		// Half the picks are uniform in [0, 100), the other half in [100, 300)
+		{SizeDistribution{Kind: SizeEmpirical, Max: 1000, Histogram: []SizeBucket{{100, 1}, {200, 0}, {300, 1}}}, 150, 5},
+	}
+
+	for _, test := range tests {
+		d := test.distribution
+
+		if err := d.Init(); err != nil {
+			t.Fatalf("%v: Init() error = %v", d.Kind, err)
+		}
+
+		sum := 0.0
+
+		for i := 0; i < samples; i++ {
+			size := d.Next()
+
+			if size < d.Min || size > d.Max {
+				t.Fatalf("%v: Next() = %v, outside [%v, %v]", d.Kind, size, d.Min, d.Max)
+			}
+
+			if d.Kind == SizeEmpirical && size >= 100 && size < 200 {
+				t.Fatalf("%v: Next() = %v, from a bucket with no weight", d.Kind, size)
+			}
+
+			sum += float64(size)
+		}
+
+		if mean := sum / samples; math.Abs(mean-test.mean) > test.tolerance {
+			t.Errorf("%v: mean size %v, want %v +/- %v", d.Kind, mean, test.mean, test.tolerance)
+		}
+	}
+}
+
+func TestSizeDistributionClamp(t *testing.T) {
+	d := SizeDistribution{Kind: SizeNormal, Min: 100, Max: 200}
+
+	tests := []struct {
+		size float64
+		want int64
+	}{
+		{150.7, 150},
+		{-5, 100},
+		{1e12, 200},
+		{math.NaN(), 100},
+		{math.Inf(1), 200},
+	}
+
+	for _, test := range tests {
+		if got := d.clamp(test.size); got != test.want {
+			t.Errorf("clamp(%v) = %v, want %v", test.size, got, test.want)
+		}
+	}
+}
+
+func TestReadHistogram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "troll-histogram")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		histogram string
+		want      []SizeBucket
+		err       bool
+	}{
+		{"# size weight\n4k 10\n\n1m 2.5\n", []SizeBucket{{4096, 10}, {1 << 20, 2.5}}, false},
+		{"", []SizeBucket{}, false},
+		{"4k\n", nil, true},
+		{"4k ten\n", nil, true},
+		{"4k -1\n", nil, true},
+		{"1m 1\n4k 1\n", nil, true},
+		{"4k 1\n4k 1\n", nil, true},
+		{"4x 1\n", nil, true},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, "histogram")
+
+		if err := ioutil.WriteFile(path, []byte(test.histogram), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ReadHistogram(path)
+
+		if (err != nil) != test.err {
+			t.Errorf("%v: ReadHistogram(%q) error = %v, want error %v", i, test.histogram, err, test.err)
+			continue
+		}
+
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: ReadHistogram(%q) = %v, want %v", i, test.histogram, got, test.want)
+		}
+	}
+
+	if _, err := ReadHistogram(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("ReadHistogram of a missing file didn't fail")
+	}
+}
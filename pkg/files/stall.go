@@ -0,0 +1,128 @@
+package files
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxStalls is how many individual stalls are kept for the timeline
+const maxStalls = 1000
+
+type Stall struct {
+	Time     time.Time
+	Op       string
+	Path     string
+	Duration time.Duration
+}
+
+type stallInterval struct {
+	Time  time.Time
+	Count int64
+}
+
+// StallDetector flags operations that take Threshold or longer, the kind of
+// multi-second stall that averages bury. It is fed from a Run loop and is
+// not safe for concurrent use
+type StallDetector struct {
+	// Threshold is how long an operation can take before it counts as a stall, 0 disables
+	Threshold time.Duration
+	Count     int64
+	Longest   time.Duration
+	Stalls    []Stall
+	intervals []stallInterval
+	current   int64
+}
+
+// Check records a stall if an operation on path that just finished took
+// duration or longer than the threshold
+func (s *StallDetector) Check(op, path string, duration time.Duration) {
+	if s.Threshold <= 0 || duration < s.Threshold {
+		return
+	}
+
+	stall := Stall{Time: time.Now().Add(-duration), Op: op, Path: path, Duration: duration}
+	fmt.Printf("Stall: %v %v took %v (started %v)\n", op, path, duration, stall.Time.Format(time.RFC3339Nano))
+
+	s.Count++
+	s.current++
+
+	if duration > s.Longest {
+		s.Longest = duration
+	}
+
+	if len(s.Stalls) < maxStalls {
+		s.Stalls = append(s.Stalls, stall)
+	}
+}
+
+// Tick closes the current interval, reporting how many stalls it saw. Quiet
+// intervals are kept too so the timeline shows when stalls stopped
+func (s *StallDetector) Tick() {
+	if s.Threshold <= 0 {
+		return
+	}
+
+	if s.current > 0 {
+		fmt.Printf("%v stalls in the last interval\n", s.current)
+	}
+
+	s.intervals = append(s.intervals, stallInterval{Time: time.Now(), Count: s.current})
+	s.current = 0
+}
+
+// Stats prints the stalls kept and the stalls per interval relative to
+// startTime, long runs have their intervals folded together
+func (s *StallDetector) Stats(startTime time.Time) {
+	if s.Threshold <= 0 {
+		return
+	}
+
+	s.Tick()
+
+	fmt.Printf("Stalls (>= %v): %v, longest %v\n", s.Threshold, s.Count, s.Longest)
+
+	if s.Count == 0 {
+		return
+	}
+
+	fmt.Println("Stall Timeline:")
+
+	for _, stall := range s.Stalls {
+		fmt.Printf("\t%v\t%v\t%v\t%v\n", stall.Time.Sub(startTime).Truncate(time.Millisecond), stall.Op, stall.Path, stall.Duration)
+	}
+
+	if s.Count > int64(len(s.Stalls)) {
+		fmt.Printf("\t... %v more\n", s.Count-int64(len(s.Stalls)))
+	}
+
+	fmt.Println("Stalls Per Interval:")
+
+	for _, interval := range foldIntervals(s.intervals, maxTimeline) {
+		fmt.Printf("\t%v\t%v\n", interval.Time.Sub(startTime).Truncate(time.Millisecond), interval.Count)
+	}
+}
+
+// foldIntervals merges neighbouring intervals so at most max are left, each
+// ending when the last one folded into it did and counting all their stalls
+func foldIntervals(intervals []stallInterval, max int) []stallInterval {
+	every := (len(intervals) + max - 1) / max
+	folded := make([]stallInterval, 0, max)
+
+	for i := 0; i < len(intervals); i += every {
+		end := i + every
+
+		if end > len(intervals) {
+			end = len(intervals)
+		}
+
+		interval := stallInterval{Time: intervals[end-1].Time}
+
+		for _, merged := range intervals[i:end] {
+			interval.Count += merged.Count
+		}
+
+		folded = append(folded, interval)
+	}
+
+	return folded
+}
@@ -0,0 +1,51 @@
+package files
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFoldIntervals(t *testing.T) {
+	start := time.Unix(0, 0)
+
+	intervals := func(counts ...int64) []stallInterval {
+		result := []stallInterval{}
+
+		for i, count := range counts {
+			result = append(result, stallInterval{Time: start.Add(time.Duration(i+1) * time.Second), Count: count})
+		}
+
+		return result
+	}
+
+	// at picks out the end times folded intervals should have
+	at := func(seconds []int, counts ...int64) []stallInterval {
+		result := []stallInterval{}
+
+		for i, count := range counts {
+			result = append(result, stallInterval{Time: start.Add(time.Duration(seconds[i]) * time.Second), Count: count})
+		}
+
+		return result
+	}
+
+	tests := []struct {
+		name      string
+		intervals []stallInterval
+		max       int
+		want      []stallInterval
+	}{
+		{"empty", intervals(), 3, []stallInterval{}},
+		{"under the cap", intervals(1, 0, 2), 3, intervals(1, 0, 2)},
+		{"pairs", intervals(1, 0, 2, 3, 0, 0), 3, at([]int{2, 4, 6}, 1, 5, 0)},
+		{"short last", intervals(1, 1, 1, 1, 1, 1, 1), 3, at([]int{3, 6, 7}, 3, 3, 1)},
+		{"one left", intervals(1, 2, 3, 4), 1, at([]int{4}, 10)},
+	}
+
+	for _, test := range tests {
+		if got := foldIntervals(test.intervals, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: foldIntervals(%v, %v) = %v, want %v", test.name, test.intervals, test.max, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package files
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	oDirect = syscall.O_DIRECT
+	oDsync  = syscall.O_DSYNC
+)
+
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
+
+func statfs(path string) (diskUsage, error) {
+	stat := syscall.Statfs_t{}
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return diskUsage{}, err
+	}
+
+	return diskUsage{
+		Total:      stat.Blocks * uint64(stat.Bsize),
+		Free:       stat.Bfree * uint64(stat.Bsize),
+		Available:  stat.Bavail * uint64(stat.Bsize),
+		Inodes:     stat.Files,
+		FreeInodes: stat.Ffree,
+	}, nil
+}
+
+func fallocate(file *os.File, offset, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, offset, size)
+}
+
+func isNotSupported(err error) bool {
+	return err == syscall.EOPNOTSUPP || err == syscall.ENOSYS
+}
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+func msync(data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// pageFaults returns the minor and major page faults of the whole process so far
+func pageFaults() (int64, int64, error) {
+	usage := syscall.Rusage{}
+
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0, err
+	}
+
+	return int64(usage.Minflt), int64(usage.Majflt), nil
+}
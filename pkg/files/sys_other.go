@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+package files
+
+import "os"
+
+const (
+	oDirect = 0
+	oDsync  = os.O_SYNC
+)
+
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
+
+func statfs(path string) (diskUsage, error) {
+	return diskUsage{}, errNotSupported
+}
+
+func fallocate(file *os.File, offset, size int64) error {
+	return errNotSupported
+}
+
+func isNotSupported(err error) bool {
+	return err == errNotSupported
+}
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func munmap(data []byte) error {
+	return errNotSupported
+}
+
+func msync(data []byte) error {
+	return errNotSupported
+}
+
+func pageFaults() (int64, int64, error) {
+	return 0, 0, errNotSupported
+}
@@ -0,0 +1,229 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// VerifyNone never reads files back
+	VerifyNone = "none"
+	// VerifyConcurrent reads back random files already written while the run goes on
+	VerifyConcurrent = "concurrent"
+	// VerifyAfter reads back every file written once the run is over
+	VerifyAfter = "after"
+)
+
+var (
+	ErrMissing   = errors.New("file is missing")
+	ErrShortRead = errors.New("file is shorter than what was written")
+	ErrCorrupt   = errors.New("checksum mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maxSample caps how many files concurrent verifies and rereads pick from
+const maxSample = 4096
+
+// writtenFile is what the replicator remembers about a file it wrote
+type writtenFile struct {
+	Path     string
+	Size     int64
+	Checksum uint32
+}
+
+type VerifyResult struct {
+	Path     string
+	Error    error
+	Duration time.Duration
+}
+
+// ValidVerify reports whether verify is one of the supported verify modes
+func ValidVerify(verify string) bool {
+	switch verify {
+	case VerifyNone, VerifyConcurrent, VerifyAfter:
+		return true
+	}
+
+	return false
+}
+
+// Checksum returns the CRC32C of body, the checksum used to verify files
+func Checksum(body []byte) uint32 {
+	return crc32.Checksum(body, castagnoli)
+}
+
+// VerifyFile reads path back and compares it against the size and CRC32C it
+// was written with, returning ErrMissing, ErrShortRead or ErrCorrupt on mismatch
+func VerifyFile(path string, size int64, checksum uint32, options Options) error {
+	flags := os.O_RDONLY
+
+	if options.Durability == DurabilityDirect {
+		flags |= oDirect
+	}
+
+	file, err := os.OpenFile(path, flags, 0)
+
+	if os.IsNotExist(err) {
+		return ErrMissing
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	buffer := options.buffer(1 << 20)
+	read := int64(0)
+	sum := uint32(0)
+
+	for {
+		n, err := file.Read(buffer)
+
+		if n > 0 {
+			if remaining := size - read; int64(n) > remaining {
+				// O_DIRECT files are padded out to the alignment
+				n = int(remaining)
+			}
+
+			sum = crc32.Update(sum, castagnoli, buffer[:n])
+			read += int64(n)
+		}
+
+		if err == io.EOF || read >= size {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if read < size {
+		return ErrShortRead
+	}
+
+	if sum != checksum {
+		return ErrCorrupt
+	}
+
+	return nil
+}
+
+func (r *Replicator) verify(file writtenFile, results chan<- *VerifyResult) {
+	startTime := time.Now()
+	err := VerifyFile(file.Path, file.Size, file.Checksum, r.Options)
+
+	results <- &VerifyResult{
+		Path:     file.Path,
+		Error:    err,
+		Duration: time.Since(startTime),
+	}
+}
+
+// addSample keeps a uniform sample of up to maxSample of the files written
+// with reservoir sampling, so long runs don't remember every file
+func (r *Replicator) addSample(file writtenFile) {
+	r.sampled++
+
+	if len(r.sample) < maxSample {
+		r.sample = append(r.sample, file)
+		return
+	}
+
+	if i := rand.Int63n(r.sampled); i < maxSample {
+		r.sample[i] = file
+	}
+}
+
+// dropSample forgets path once it has been deleted
+func (r *Replicator) dropSample(path string) {
+	for i, file := range r.sample {
+		if file.Path == path {
+			r.sample[i] = r.sample[len(r.sample)-1]
+			r.sample = r.sample[:len(r.sample)-1]
+			return
+		}
+	}
+}
+
+// verifyRandom checks one of the files sampled so far
+func (r *Replicator) verifyRandom(results chan<- *VerifyResult) bool {
+	if len(r.sample) == 0 {
+		return false
+	}
+
+	go r.verify(r.sample[rand.Intn(len(r.sample))], results)
+
+	return true
+}
+
+func (r *Replicator) recordVerify(result *VerifyResult) {
+	r.ReadLatency.Add(result.Duration)
+	r.Stalls.Check("read", result.Path, result.Duration)
+
+	switch result.Error {
+	case nil:
+		r.FilesVerified++
+		return
+	case ErrMissing:
+		if !r.tracked(result.Path) {
+			// Deleted by the retention policy while it was being read
+			return
+		}
+		r.MissingFiles++
+	case ErrShortRead:
+		r.ShortReads++
+	case ErrCorrupt:
+		r.CorruptFiles++
+	default:
+		r.VerifyErrors++
+	}
+
+	fmt.Printf("Verify failed for %v: %v\n", result.Path, result.Error)
+}
+
+// VerifyAll reads back every file written during the run using up to
+// MaxWorkers readers, it is meant to be called once Run has returned
+func (r *Replicator) VerifyAll() {
+	results := make(chan *VerifyResult, r.MaxWorkers)
+	queue := make(chan writtenFile)
+	wg := sync.WaitGroup{}
+
+	fmt.Printf("Verifying %v files\n", len(r.written))
+
+	for i := int64(0); i < r.MaxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				r.verify(file, results)
+			}
+		}()
+	}
+
+	go func() {
+		for _, file := range r.written {
+			queue <- file
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		r.recordVerify(result)
+	}
+}
+
+func (r *Replicator) verifyStats() {
+	fmt.Printf("Files Verified: %v (%v corrupt, %v short, %v missing, %v errors)\n", r.FilesVerified, r.CorruptFiles, r.ShortReads, r.MissingFiles, r.VerifyErrors)
+	fmt.Printf("Read Time: %v\n", &r.ReadLatency)
+}
@@ -0,0 +1,155 @@
+package mem
+
+import (
+	"os"
+	"sync"
+)
+
+// ChunkSize is the most an Arena allocates at once, keeping allocations
+// small enough to be handed back to the OS piece by piece
+const ChunkSize = 64 << 20
+
+// Arena holds an exact number of bytes of memory, touching every page as
+// it's allocated so the memory is resident rather than just reserved. It can
+// be resized while Write and Read run on other goroutines
+type Arena struct {
+	lock   sync.RWMutex
+	chunks [][]byte
+	size   int64
+}
+
+// Size is how many bytes the arena holds
+func (a *Arena) Size() int64 {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.size
+}
+
+// newChunk allocates length bytes and faults every page in
+func newChunk(length int64) []byte {
+	chunk := make([]byte, length)
+
+	for i := 0; i < len(chunk); i += os.Getpagesize() {
+		chunk[i] = 1
+	}
+
+	return chunk
+}
+
+// Grow allocates size more bytes and faults every page in
+func (a *Arena) Grow(size int64) {
+	for size > 0 {
+		length := size
+
+		if length > ChunkSize {
+			length = ChunkSize
+		}
+
+		chunk := newChunk(length)
+
+		a.lock.Lock()
+		a.chunks = append(a.chunks, chunk)
+		a.size += length
+		a.lock.Unlock()
+
+		size -= length
+	}
+}
+
+// Shrink drops size bytes off the end of the arena, a chunk that's only
+// partly dropped is copied into a smaller one so exactly size bytes are let go.
+// It's up to the garbage collector to give them back to the OS
+func (a *Arena) Shrink(size int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for size > 0 && len(a.chunks) > 0 {
+		last := a.chunks[len(a.chunks)-1]
+		length := int64(len(last))
+
+		if length <= size {
+			a.chunks[len(a.chunks)-1] = nil
+			a.chunks = a.chunks[:len(a.chunks)-1]
+			a.size -= length
+			size -= length
+			continue
+		}
+
+		chunk := newChunk(length - size)
+		copy(chunk, last)
+		a.chunks[len(a.chunks)-1] = chunk
+		a.size -= size
+		size = 0
+	}
+}
+
+// Release drops everything the arena holds, it's up to the garbage collector
+// to give it back to the OS
+func (a *Arena) Release() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.chunks = nil
+	a.size = 0
+}
+
+// each calls fn with the pieces of the arena making up [offset, offset+length)
+func (a *Arena) each(offset, length int64, fn func([]byte)) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, chunk := range a.chunks {
+		if length <= 0 {
+			return
+		}
+
+		chunkLength := int64(len(chunk))
+
+		if offset >= chunkLength {
+			offset -= chunkLength
+			continue
+		}
+
+		end := offset + length
+
+		if end > chunkLength {
+			end = chunkLength
+		}
+
+		fn(chunk[offset:end])
+		length -= end - offset
+		offset = 0
+	}
+}
+
+// Write increments every byte in [offset, offset+length), returning how many bytes it wrote
+func (a *Arena) Write(offset, length int64) int64 {
+	written := int64(0)
+
+	a.each(offset, length, func(piece []byte) {
+		for i := range piece {
+			piece[i]++
+		}
+
+		written += int64(len(piece))
+	})
+
+	return written
+}
+
+// Read sums every byte in [offset, offset+length), returning the sum and how many bytes it read
+func (a *Arena) Read(offset, length int64) (int, int64) {
+	sum := 0
+	read := int64(0)
+
+	a.each(offset, length, func(piece []byte) {
+		for _, b := range piece {
+			sum += int(b)
+		}
+
+		read += int64(len(piece))
+	})
+
+	return sum, read
+}
@@ -0,0 +1,267 @@
+package mem
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Modes pick what the Replicator's workers do
+const (
+	// ModePressure holds memory following the Profile and writes to it
+	ModePressure = "pressure"
+	// ModeBandwidth runs the STREAM copy, scale, add and triad kernels
+	ModeBandwidth = "bandwidth"
+	// ModeLatency chases pointers through working sets of increasing size
+	ModeLatency = "latency"
+	// ModeGC allocates small objects in pointer graphs to keep the garbage collector busy
+	ModeGC = "gc"
+)
+
+// Kernels are the STREAM kernels in the order each bandwidth job runs them
+var Kernels = []string{"copy", "scale", "add", "triad"}
+
+// MinWorkingSet is the smallest working set the latency sweep starts from
+const MinWorkingSet = 4 << 10
+
+// cacheLine is how far apart the pointers being chased are, so every access
+// is to a different line
+const cacheLine = 64
+
+// chaseAccesses is how many pointers each latency job follows
+const chaseAccesses = 1 << 22
+
+// ValidMode reports whether mode is one of the supported modes
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModePressure, ModeBandwidth, ModeLatency, ModeGC:
+		return true
+	}
+
+	return false
+}
+
+// Measurement is one timed run of a kernel or a pointer chase
+type Measurement struct {
+	Name       string
+	WorkingSet int64
+	Bytes      int64
+	Accesses   int64
+	Duration   time.Duration
+}
+
+// stream holds a worker's STREAM arrays
+type stream struct {
+	a, b, c []float64
+}
+
+func newStream(workingSet int64) *stream {
+	n := workingSet / 24
+	s := &stream{a: make([]float64, n), b: make([]float64, n), c: make([]float64, n)}
+
+	for i := range s.a {
+		s.a[i] = 1
+		s.b[i] = 2
+	}
+
+	return s
+}
+
+// run times each of the Kernels once over the arrays
+func (s *stream) run() []Measurement {
+	const scalar = 3.0
+	n := int64(len(s.a))
+	measurements := make([]Measurement, 0, len(Kernels))
+	a, b, c := s.a, s.b, s.c
+
+	for _, kernel := range Kernels {
+		startTime := time.Now()
+		bytes := 24 * n
+
+		switch kernel {
+		case "copy":
+			copy(c, a)
+			bytes = 16 * n
+		case "scale":
+			for i := range b {
+				b[i] = scalar * c[i]
+			}
+			bytes = 16 * n
+		case "add":
+			for i := range c {
+				c[i] = a[i] + b[i]
+			}
+		case "triad":
+			for i := range a {
+				a[i] = b[i] + scalar*c[i]
+			}
+		}
+
+		measurements = append(measurements, Measurement{Name: kernel, WorkingSet: 24 * n, Bytes: bytes, Duration: time.Since(startTime)})
+	}
+
+	return measurements
+}
+
+// chase builds a random cycle through every cache line of a workingSet byte
+// buffer and times following it, returning where it ended up so the loop
+// can't be optimized away
+func chase(workingSet int64) (Measurement, int) {
+	const stride = cacheLine / 8
+	lines := int(workingSet / cacheLine)
+	next := make([]int, lines*stride)
+
+	for line := 0; line < lines; line++ {
+		next[line*stride] = line * stride
+	}
+
+	// Sattolo's shuffle leaves a single cycle through every line, built in
+	// place so nothing but the working set is allocated
+	for i := lines - 1; i > 0; i-- {
+		j := rand.Intn(i)
+		next[i*stride], next[j*stride] = next[j*stride], next[i*stride]
+	}
+
+	p := 0
+	startTime := time.Now()
+
+	for i := 0; i < chaseAccesses; i++ {
+		p = next[p]
+	}
+
+	duration := time.Since(startTime)
+
+	return Measurement{Name: "latency", WorkingSet: workingSet, Accesses: chaseAccesses, Duration: duration}, p
+}
+
+// workingSets doubles from MinWorkingSet up to max, crossing the cache levels on the way to DRAM
+func workingSets(max int64) []int64 {
+	sets := []int64{}
+
+	for size := int64(MinWorkingSet); size <= max; size *= 2 {
+		sets = append(sets, size)
+	}
+
+	return sets
+}
+
+// benchStats adds up the measurements of one kernel or working set
+type benchStats struct {
+	Runs     int64
+	Bytes    int64
+	Accesses int64
+	Duration time.Duration
+	Best     float64
+	// workers keeps each worker's share, so concurrent rates can be summed
+	workers map[int64]*benchStats
+}
+
+func (b *benchStats) add(worker int64, m Measurement) {
+	b.Runs++
+	b.Bytes += m.Bytes
+	b.Accesses += m.Accesses
+	b.Duration += m.Duration
+
+	rate := m.rate()
+
+	if b.Runs == 1 || (m.Bytes > 0 && rate > b.Best) || (m.Bytes == 0 && rate < b.Best) {
+		b.Best = rate
+	}
+
+	if b.workers == nil {
+		b.workers = make(map[int64]*benchStats)
+	}
+
+	if _, ok := b.workers[worker]; !ok {
+		b.workers[worker] = &benchStats{}
+	}
+
+	share := b.workers[worker]
+	share.Bytes += m.Bytes
+	share.Duration += m.Duration
+}
+
+// gbPerSecond is the average bandwidth of one worker
+func (b *benchStats) gbPerSecond() float64 {
+	if b.Duration <= 0 {
+		return 0
+	}
+
+	return float64(b.Bytes) / b.Duration.Seconds() / 1e9
+}
+
+// combined sums the average bandwidth of every worker, what they pull
+// together when running at the same time
+func (b *benchStats) combined() float64 {
+	total := 0.0
+
+	for _, share := range b.workers {
+		total += share.gbPerSecond()
+	}
+
+	return total
+}
+
+func (b *benchStats) nsPerAccess() float64 {
+	if b.Accesses == 0 {
+		return 0
+	}
+
+	return float64(b.Duration.Nanoseconds()) / float64(b.Accesses)
+}
+
+// rate is GB/s for bandwidth and ns/access for latency
+func (m Measurement) rate() float64 {
+	if m.Bytes > 0 {
+		return float64(m.Bytes) / m.Duration.Seconds() / 1e9
+	}
+
+	if m.Accesses == 0 {
+		return 0
+	}
+
+	return float64(m.Duration.Nanoseconds()) / float64(m.Accesses)
+}
+
+func (m Measurement) String() string {
+	if m.Bytes > 0 {
+		return fmt.Sprintf("%v %.2f GB/s", m.Name, m.rate())
+	}
+
+	return fmt.Sprintf("%v bytes %.2f ns/access", m.WorkingSet, m.rate())
+}
+
+func (r *Replicator) benchStats() {
+	switch r.Mode {
+	case ModeBandwidth:
+		fmt.Printf("Bandwidth (%v bytes per worker):\n", r.MaxSize/r.MaxWorkers)
+		fmt.Println("\tKernel\tRuns\tBest GB/s\tAverage GB/s\tAll Workers GB/s")
+
+		for _, kernel := range Kernels {
+			stats, ok := r.bandwidth[kernel]
+
+			if !ok {
+				continue
+			}
+
+			fmt.Printf("\t%v\t%v\t%.2f\t%.2f\t%.2f\n", kernel, stats.Runs, stats.Best, stats.gbPerSecond(), stats.combined())
+		}
+	case ModeLatency:
+		sets := make([]int64, 0, len(r.latency))
+
+		for set := range r.latency {
+			sets = append(sets, set)
+		}
+
+		sort.Slice(sets, func(i, j int) bool { return sets[i] < sets[j] })
+
+		fmt.Println("Latency:")
+		fmt.Println("\tWorking Set\tRuns\tBest ns/access\tAverage ns/access")
+
+		for _, set := range sets {
+			stats := r.latency[set]
+			fmt.Printf("\t%v\t%v\t%.2f\t%.2f\n", set, stats.Runs, stats.Best, stats.nsPerAccess())
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package mem
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime/metrics"
+	"time"
+)
+
+// gcBatch is how many objects a worker allocates between checking the clock
+const gcBatch = 1000
+
+// gcReport is how often workers report what they've allocated
+const gcReport = 100 * time.Millisecond
+
+// maxTimeline is the most heap samples printed in the final stats
+const maxTimeline = 60
+
+// nodeOverhead is roughly what a node costs before its refs and payload
+const nodeOverhead = 48
+
+// GCOptions shape the garbage the gc mode makes
+type GCOptions struct {
+	// ObjectSize is roughly how big each object is including its pointers
+	ObjectSize int64
+	// Pointers is how many other live objects each new object points to
+	Pointers int
+	// Lifetime is how long an object stays reachable before it's dropped. A
+	// dropped object is still reachable from younger objects pointing at it
+	// until they're dropped too, so it can be reachable for up to twice Lifetime
+	Lifetime time.Duration
+	// AllocRate caps the bytes per second allocated across all workers, 0 doesn't
+	AllocRate int64
+}
+
+// node is one object in the graph, pointing at objects allocated before it
+type node struct {
+	refs    []*node
+	payload []byte
+}
+
+type liveNode struct {
+	node *node
+	born time.Time
+}
+
+// gcSnapshot is the runtime's view of the heap and GC at one point in time
+type gcSnapshot struct {
+	Time        time.Time
+	Cycles      uint64
+	Allocated   uint64
+	Objects     uint64
+	Heap        uint64
+	Live        uint64
+	Goal        uint64
+	GOGC        uint64
+	MemoryLimit uint64
+	GCCPU       float64
+	TotalCPU    float64
+	Pauses      *metrics.Float64Histogram
+}
+
+// pauseMetrics are the GC pause histograms, newest first, as the names have
+// changed between Go releases
+var pauseMetrics = []string{"/sched/pauses/total/gc:seconds", "/gc/pauses:seconds"}
+
+var gcMetrics = []string{
+	"/gc/cycles/total:gc-cycles",
+	"/gc/heap/allocs:bytes",
+	"/gc/heap/allocs:objects",
+	"/memory/classes/heap/objects:bytes",
+	"/gc/heap/live:bytes",
+	"/gc/heap/goal:bytes",
+	"/gc/gogc:percent",
+	"/gc/gomemlimit:bytes",
+	"/cpu/classes/gc/total:cpu-seconds",
+	"/cpu/classes/total:cpu-seconds",
+}
+
+// readGC reads a snapshot out of runtime/metrics, anything the running Go
+// release doesn't support reads as 0
+func readGC() gcSnapshot {
+	samples := make([]metrics.Sample, 0, len(gcMetrics)+len(pauseMetrics))
+
+	for _, name := range append(gcMetrics, pauseMetrics...) {
+		samples = append(samples, metrics.Sample{Name: name})
+	}
+
+	metrics.Read(samples)
+
+	values := make(map[string]metrics.Value)
+
+	for _, sample := range samples {
+		values[sample.Name] = sample.Value
+	}
+
+	integer := func(name string) uint64 {
+		if values[name].Kind() != metrics.KindUint64 {
+			return 0
+		}
+
+		return values[name].Uint64()
+	}
+
+	float := func(name string) float64 {
+		if values[name].Kind() != metrics.KindFloat64 {
+			return 0
+		}
+
+		return values[name].Float64()
+	}
+
+	snapshot := gcSnapshot{
+		Time:        time.Now(),
+		Cycles:      integer("/gc/cycles/total:gc-cycles"),
+		Allocated:   integer("/gc/heap/allocs:bytes"),
+		Objects:     integer("/gc/heap/allocs:objects"),
+		Heap:        integer("/memory/classes/heap/objects:bytes"),
+		Live:        integer("/gc/heap/live:bytes"),
+		Goal:        integer("/gc/heap/goal:bytes"),
+		GOGC:        integer("/gc/gogc:percent"),
+		MemoryLimit: integer("/gc/gomemlimit:bytes"),
+		GCCPU:       float("/cpu/classes/gc/total:cpu-seconds"),
+		TotalCPU:    float("/cpu/classes/total:cpu-seconds"),
+	}
+
+	for _, name := range pauseMetrics {
+		if values[name].Kind() == metrics.KindFloat64Histogram {
+			snapshot.Pauses = values[name].Float64Histogram()
+			break
+		}
+	}
+
+	return snapshot
+}
+
+// gcCPU is the fraction of CPU time spent on GC between two snapshots
+func gcCPU(from, to gcSnapshot) float64 {
+	total := to.TotalCPU - from.TotalCPU
+
+	if total <= 0 {
+		return 0
+	}
+
+	return (to.GCCPU - from.GCCPU) / total
+}
+
+// pausePercentiles picks percentiles out of the pauses between two snapshots,
+// each is the upper bound of the bucket it lands in
+func pausePercentiles(from, to gcSnapshot, percentiles ...float64) (uint64, []time.Duration) {
+	durations := make([]time.Duration, len(percentiles))
+
+	if to.Pauses == nil {
+		return 0, durations
+	}
+
+	counts := make([]uint64, len(to.Pauses.Counts))
+	total := uint64(0)
+
+	for i, count := range to.Pauses.Counts {
+		counts[i] = count
+
+		if from.Pauses != nil && i < len(from.Pauses.Counts) {
+			counts[i] -= from.Pauses.Counts[i]
+		}
+
+		total += counts[i]
+	}
+
+	if total == 0 {
+		return 0, durations
+	}
+
+	for p, percentile := range percentiles {
+		rank := uint64(math.Ceil(percentile / 100 * float64(total)))
+		seen := uint64(0)
+
+		for i, count := range counts {
+			seen += count
+
+			if count == 0 || seen < rank {
+				continue
+			}
+
+			upper := to.Pauses.Buckets[i+1]
+
+			if math.IsInf(upper, 1) {
+				upper = to.Pauses.Buckets[i]
+			}
+
+			durations[p] = time.Duration(upper * float64(time.Second))
+			break
+		}
+	}
+
+	return total, durations
+}
+
+// churn allocates objects until the run ends, keeping each reachable for
+// Lifetime and the worker's live objects under its share of MaxSize
+func (r *Replicator) churn(worker int64, results chan<- *Result) {
+	budget := r.MaxSize / r.MaxWorkers
+	rate := float64(r.GC.AllocRate) / float64(r.MaxWorkers)
+	payloadSize := r.GC.ObjectSize - nodeOverhead - int64(8*r.GC.Pointers)
+
+	if payloadSize < 0 {
+		payloadSize = 0
+	}
+
+	live := []liveNode{}
+	head := 0
+	liveBytes := int64(0)
+	allocated := int64(0)
+	startTime := time.Now()
+	result := &Result{Worker: worker}
+	lastReport := startTime
+
+	for {
+		select {
+		case <-r.Context.Done():
+			return
+		default:
+		}
+
+		now := time.Now()
+
+		for i := 0; i < gcBatch; i++ {
+			n := &node{refs: make([]*node, 0, r.GC.Pointers)}
+
+			if payloadSize > 0 {
+				n.payload = make([]byte, payloadSize)
+			}
+
+			for p := 0; p < r.GC.Pointers && len(live) > head; p++ {
+				n.refs = append(n.refs, live[head+rand.Intn(len(live)-head)].node)
+			}
+
+			live = append(live, liveNode{node: n, born: now})
+			liveBytes += r.GC.ObjectSize
+		}
+
+		allocated += gcBatch * r.GC.ObjectSize
+		result.BytesWritten += gcBatch * r.GC.ObjectSize
+		result.Objects += gcBatch
+
+		// Expired objects let go of what they point to as well, otherwise
+		// young objects would keep every generation before them reachable.
+		// They stay reachable themselves until whatever points at them expires
+		for head < len(live) && (now.Sub(live[head].born) >= r.GC.Lifetime || liveBytes > budget) {
+			live[head].node.refs = nil
+			live[head] = liveNode{}
+			head++
+			liveBytes -= r.GC.ObjectSize
+		}
+
+		if head > len(live)/2 {
+			kept := copy(live, live[head:])
+
+			for i := kept; i < len(live); i++ {
+				live[i] = liveNode{}
+			}
+
+			live = live[:kept]
+			head = 0
+		}
+
+		if rate > 0 {
+			ahead := time.Duration(float64(allocated)/rate*float64(time.Second)) - time.Since(startTime)
+
+			if ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+
+		if time.Since(lastReport) < gcReport {
+			continue
+		}
+
+		result.Duration = time.Since(lastReport)
+		result.LiveBytes = liveBytes
+
+		select {
+		case results <- result:
+		case <-r.Context.Done():
+			return
+		}
+
+		result = &Result{Worker: worker}
+		lastReport = time.Now()
+	}
+}
+
+// churned adds up what a gc worker has allocated since it last reported
+func (r *Replicator) churned(result *Result) {
+	r.BytesWritten += uint64(result.BytesWritten)
+	r.ObjectsAllocated += result.Objects
+	r.liveBytes[result.Worker] = result.LiveBytes
+}
+
+// sampleGC reports the heap and GC since the last tick and keeps it for the timeline
+func (r *Replicator) sampleGC() {
+	snapshot := readGC()
+	last := r.gcStart
+
+	if len(r.gcSamples) > 0 {
+		last = r.gcSamples[len(r.gcSamples)-1]
+	}
+
+	r.gcSamples = append(r.gcSamples, snapshot)
+
+	live := int64(0)
+
+	for _, bytes := range r.liveBytes {
+		live += bytes
+	}
+
+	interval := snapshot.Time.Sub(last.Time).Seconds()
+	pauses, percentiles := pausePercentiles(last, snapshot, 99)
+
+	fmt.Printf("Alloc: %.2f MB/s, Kept Live: %v bytes, Heap: %v bytes (goal %v), GCs: %v, Pauses: %v (p99 %v), GC CPU: %.2f%%\n",
+		float64(snapshot.Allocated-last.Allocated)/interval/1e6, live, snapshot.Heap, snapshot.Goal,
+		snapshot.Cycles-last.Cycles, pauses, percentiles[0], gcCPU(last, snapshot)*100)
+}
+
+func (r *Replicator) gcStats() {
+	end := readGC()
+	totalTime := end.Time.Sub(r.gcStart.Time)
+
+	fmt.Printf("GOGC: %v, Memory Limit: %v bytes\n", gogc(end.GOGC), end.MemoryLimit)
+	fmt.Printf("Objects: %v bytes each with %v pointers, living %v\n", r.GC.ObjectSize, r.GC.Pointers, r.GC.Lifetime)
+	fmt.Printf("Allocated: %v bytes (%.2f MB/s), %v objects (%.0f/sec) by the workers\n", r.BytesWritten, float64(r.BytesWritten)/totalTime.Seconds()/1e6, r.ObjectsAllocated, float64(r.ObjectsAllocated)/totalTime.Seconds())
+	fmt.Printf("Heap Allocations: %v bytes, %v objects by the whole process\n", end.Allocated-r.gcStart.Allocated, end.Objects-r.gcStart.Objects)
+	fmt.Printf("GC Cycles: %v (%.2f/sec)\n", end.Cycles-r.gcStart.Cycles, float64(end.Cycles-r.gcStart.Cycles)/totalTime.Seconds())
+	fmt.Printf("GC CPU Fraction: %.2f%%\n", gcCPU(r.gcStart, end)*100)
+
+	pauses, percentiles := pausePercentiles(r.gcStart, end, 50, 90, 99, 99.9, 100)
+	fmt.Printf("GC Pauses: %v, p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n", pauses, percentiles[0], percentiles[1], percentiles[2], percentiles[3], percentiles[4])
+
+	if len(r.gcSamples) == 0 {
+		return
+	}
+
+	fmt.Println("Heap Timeline:")
+	fmt.Println("\tTime\tHeap\tLive\tGoal\tGCs\tGC CPU")
+
+	every := (len(r.gcSamples) + maxTimeline - 1) / maxTimeline
+	last := r.gcStart
+
+	for i := every - 1; i < len(r.gcSamples); i += every {
+		sample := r.gcSamples[i]
+		fmt.Printf("\t%v\t%v\t%v\t%v\t%v\t%.2f%%\n", sample.Time.Sub(r.gcStart.Time).Truncate(time.Millisecond), sample.Heap, sample.Live, sample.Goal, sample.Cycles-r.gcStart.Cycles, gcCPU(last, sample)*100)
+		last = sample
+	}
+}
+
+func gogc(percent uint64) string {
+	if percent == math.MaxUint64 || int64(percent) < 0 {
+		return "off"
+	}
+
+	return fmt.Sprintf("%v", percent)
+}
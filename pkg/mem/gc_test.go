@@ -0,0 +1,63 @@
+package mem
+
+import (
+	"math"
+	"reflect"
+	"runtime/metrics"
+	"testing"
+	"time"
+)
+
+func TestPausePercentiles(t *testing.T) {
+	// Buckets of [0, 1ms), [1ms, 10ms), [10ms, 100ms) and [100ms, +Inf)
+	buckets := []float64{0, 0.001, 0.01, 0.1, math.Inf(1)}
+
+	pauses := func(counts ...uint64) gcSnapshot {
+		return gcSnapshot{Pauses: &metrics.Float64Histogram{Counts: counts, Buckets: buckets}}
+	}
+
+	ms := time.Millisecond
+
+	tests := []struct {
+		name        string
+		from, to    gcSnapshot
+		percentiles []float64
+		total       uint64
+		want        []time.Duration
+	}{
+		{"no histogram", gcSnapshot{}, gcSnapshot{}, []float64{50, 99}, 0, []time.Duration{0, 0}},
+		{"no pauses", pauses(0, 0, 0, 0), pauses(0, 0, 0, 0), []float64{50}, 0, []time.Duration{0}},
+		{"no pauses since", pauses(5, 1, 0, 0), pauses(5, 1, 0, 0), []float64{50}, 0, []time.Duration{0}},
+		{"from the start", gcSnapshot{}, pauses(90, 9, 1, 0), []float64{50, 90, 99, 100}, 100, []time.Duration{ms, ms, 10 * ms, 100 * ms}},
+		{"upper bound of the bucket", gcSnapshot{}, pauses(0, 4, 0, 0), []float64{1, 100}, 4, []time.Duration{10 * ms, 10 * ms}},
+		{"rank rounds up", gcSnapshot{}, pauses(1, 1, 0, 0), []float64{50, 51}, 2, []time.Duration{ms, 10 * ms}},
+		{"since the last snapshot", pauses(90, 0, 0, 0), pauses(90, 2, 2, 0), []float64{50, 100}, 4, []time.Duration{10 * ms, 100 * ms}},
+		{"unbounded bucket", gcSnapshot{}, pauses(1, 0, 0, 1), []float64{50, 100}, 2, []time.Duration{ms, 100 * ms}},
+		{"no percentiles", gcSnapshot{}, pauses(1, 0, 0, 0), nil, 1, []time.Duration{}},
+	}
+
+	for _, test := range tests {
+		total, got := pausePercentiles(test.from, test.to, test.percentiles...)
+
+		if total != test.total || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: pausePercentiles(%v) = %v, %v, want %v, %v", test.name, test.percentiles, total, got, test.total, test.want)
+		}
+	}
+}
+
+func TestGCCPU(t *testing.T) {
+	tests := []struct {
+		from, to gcSnapshot
+		want     float64
+	}{
+		{gcSnapshot{}, gcSnapshot{GCCPU: 1, TotalCPU: 4}, 0.25},
+		{gcSnapshot{GCCPU: 1, TotalCPU: 4}, gcSnapshot{GCCPU: 1.5, TotalCPU: 6}, 0.25},
+		{gcSnapshot{GCCPU: 1, TotalCPU: 4}, gcSnapshot{GCCPU: 1, TotalCPU: 4}, 0},
+	}
+
+	for _, test := range tests {
+		if got := gcCPU(test.from, test.to); got != test.want {
+			t.Errorf("gcCPU(%+v, %+v) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package mem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alyssadaemon/troll/pkg/cgroup"
+	"github.com/alyssadaemon/troll/pkg/units"
+)
+
+// ParseLimitString parses sizes the same as units.ParseSize, and percentages
+// like 90% relative to the tightest memory limit of group and its ancestors.
+// When group is nil or none of them has a limit the percentage is of the
+// host's total memory instead
+func ParseLimitString(limitString string, group *cgroup.Cgroup) (int64, error) {
+	if !strings.HasSuffix(limitString, "%") {
+		return units.ParseSize(limitString)
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(limitString, "%"), 64)
+
+	if err != nil || percent < 0 {
+		return 0, fmt.Errorf("unable to parse %v as a percentage", limitString)
+	}
+
+	limit := int64(0)
+
+	if group != nil {
+		limit, err = group.EffectiveLimit()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if limit == 0 {
+		limit, err = TotalMemory()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(float64(limit) * percent / 100), nil
+}
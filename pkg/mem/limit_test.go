@@ -0,0 +1,107 @@
+package mem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alyssadaemon/troll/pkg/cgroup"
+)
+
+// fakeCgroup lays out a cgroup hierarchy under a temporary directory, limits
+// go from the topmost cgroup down to the leaf, "" leaves the limit file out
+func fakeCgroup(t *testing.T, version int, limits ...string) (*cgroup.Cgroup, func()) {
+	root, err := ioutil.TempDir("", "troll-cgroup")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limitFile := "memory.max"
+
+	if version == 1 {
+		limitFile = "memory.limit_in_bytes"
+	}
+
+	dir := root
+
+	for i, limit := range limits {
+		dir = filepath.Join(dir, string('a'+rune(i)))
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if limit == "" {
+			continue
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, limitFile), []byte(limit+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &cgroup.Cgroup{Version: version, Path: dir}, func() { os.RemoveAll(root) }
+}
+
+func TestParseLimitString(t *testing.T) {
+	host, err := TotalMemory()
+
+	if err != nil {
+		t.Skipf("no /proc/meminfo: %v", err)
+	}
+
+	// v1 reports no limit as the largest page aligned int64
+	const v1Unlimited = "9223372036854771712"
+
+	tests := []struct {
+		name    string
+		limit   string
+		version int
+		// limits is the fake hierarchy, nil means no cgroup at all
+		limits []string
+		want   int64
+		err    bool
+	}{
+		{"size", "1G", 2, nil, 1 << 30, false},
+		{"bytes", "512", 2, nil, 512, false},
+		{"invalid size", "lots", 2, nil, 0, true},
+		{"no cgroup", "50%", 2, nil, host / 2, false},
+		{"leaf limit", "50%", 2, []string{"max", "1000"}, 500, false},
+		{"fractional percent", "12.5%", 2, []string{"1000"}, 125, false},
+		{"zero percent", "0%", 2, []string{"1000"}, 0, false},
+		{"parent limit", "50%", 2, []string{"4000", "max", "max"}, 2000, false},
+		{"tightest ancestor", "50%", 2, []string{"1000", "3000", "max"}, 500, false},
+		{"leaf tighter than parent", "50%", 2, []string{"3000", "2000"}, 1000, false},
+		{"gap in the hierarchy", "50%", 2, []string{"1000", "", "max"}, host / 2, false},
+		{"unlimited", "90%", 2, []string{"max", "max"}, int64(float64(host) * 90 / 100), false},
+		{"v1 leaf", "50%", 1, []string{v1Unlimited, "2000"}, 1000, false},
+		{"v1 parent", "50%", 1, []string{"2000", v1Unlimited}, 1000, false},
+		{"v1 unlimited", "50%", 1, []string{v1Unlimited, v1Unlimited}, host / 2, false},
+		{"negative percent", "-5%", 2, []string{"1000"}, 0, true},
+		{"invalid percent", "half%", 2, []string{"1000"}, 0, true},
+		{"corrupt limit", "50%", 2, []string{"lots"}, 0, true},
+	}
+
+	for _, test := range tests {
+		var group *cgroup.Cgroup
+
+		if test.limits != nil {
+			var cleanup func()
+			group, cleanup = fakeCgroup(t, test.version, test.limits...)
+			defer cleanup()
+		}
+
+		got, err := ParseLimitString(test.limit, group)
+
+		if (err != nil) != test.err {
+			t.Errorf("%v: ParseLimitString(%q) error = %v, want error %v", test.name, test.limit, err, test.err)
+			continue
+		}
+
+		if !test.err && got != test.want {
+			t.Errorf("%v: ParseLimitString(%q) = %v, want %v", test.name, test.limit, got, test.want)
+		}
+	}
+}
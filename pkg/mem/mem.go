@@ -3,14 +3,13 @@ package mem
 import (
 	"context"
 	"fmt"
-	"math"
 	"math/rand"
 	"runtime"
-	"strconv"
+	"runtime/debug"
 	"strings"
-	"sync"
 	"time"
-	"unsafe"
+
+	"github.com/alyssadaemon/troll/pkg/cgroup"
 )
 
 type Result struct {
@@ -19,8 +18,24 @@ type Result struct {
 	BytesRead    int64
 	Error        error
 	MagicNumber  int
+	Worker       int64
+	Measurements []Measurement
+	Objects      int64
+	// LiveBytes is how much a gc worker is keeping alive
+	LiveBytes int64
 }
 
+// Replicator allocates MaxSize bytes up front and holds them, every page is
+// touched so they count towards RSS. With a Profile other than hold the
+// memory held is resized every tick to follow it instead. Each worker owns an
+// equal region of the memory and every tick writes, and optionally reads, a
+// random range of it. With ReleaseMemory nothing is held, each job allocates
+// its range instead and drops it when it's done.
+//
+// In the bandwidth and latency Modes nothing is held, each worker benchmarks
+// MaxSize/MaxWorkers bytes of its own instead. In the gc mode workers run for
+// the whole run making garbage shaped by GC, keeping their live objects under
+// MaxSize/MaxWorkers bytes
 type Replicator struct {
 	Ticker         *time.Ticker
 	MaxSize        int64
@@ -31,13 +46,36 @@ type Replicator struct {
 	BytesRead      uint64
 	TimeRunning    time.Duration
 	ReleaseMemory  bool
-	RAM            []int
+	Arena          Arena
 	Read           bool
 	Force          bool
 	StartTime      time.Time
 	ShortestTime   time.Duration
 	LongestTime    time.Duration
 	JobsCompleted  int64
+	AllocationTime time.Duration
+	Profile        Profile
+	PeakHeld       int64
+	BytesAllocated int64
+	BytesFreed     int64
+	// Cgroup is the memory cgroup to report on, nil skips it
+	Cgroup      *cgroup.Cgroup
+	startEvents cgroup.Events
+	lastEvents  cgroup.Events
+	// Mode is one of the Mode consts, empty is ModePressure
+	Mode      string
+	bandwidth map[string]*benchStats
+	latency   map[int64]*benchStats
+	streams   []*stream
+	sets      []int64
+	nextSet   int
+	// GC shapes the objects allocated in the gc mode
+	GC               GCOptions
+	ObjectsAllocated int64
+	gcStart          gcSnapshot
+	gcSamples        []gcSnapshot
+	liveBytes        []int64
+	busy             []bool
 }
 
 func (r *Replicator) Stats() {
@@ -57,22 +95,112 @@ func (r *Replicator) Stats() {
 	fmt.Printf("Total Run Duration %v\n", totalTime)
 	fmt.Printf("Max Concurrency %v\n", r.MaxWorkers)
 	fmt.Printf("Jobs Completed: %v\n", r.JobsCompleted)
-	fmt.Printf("Bytes Written: %v, Bytes Read: %v\n", r.BytesWritten, r.BytesRead)
-	fmt.Printf("Average completion time: %v\n", avgRespTime)
-	fmt.Printf("Shortest Job Time %v\n", r.ShortestTime)
-	fmt.Printf("Longest Job Time: %v\n", r.LongestTime)
 
+	switch {
+	case r.Mode == ModeGC:
+		r.gcStats()
+	case r.benchmarking():
+		fmt.Printf("Average completion time: %v\n", avgRespTime)
+		r.benchStats()
+	default:
+		fmt.Printf("Bytes Written: %v, Bytes Read: %v\n", r.BytesWritten, r.BytesRead)
+		fmt.Printf("Average completion time: %v\n", avgRespTime)
+		fmt.Printf("Shortest Job Time %v\n", r.ShortestTime)
+		fmt.Printf("Longest Job Time: %v\n", r.LongestTime)
+	}
+
+	if !r.ReleaseMemory && (r.pressure() || r.Mode == ModeBandwidth) {
+		fmt.Printf("Allocation Time: %v\n", r.AllocationTime)
+	}
+
+	if r.pressure() {
+		fmt.Printf("Requested Memory: %v bytes, Held: %v bytes\n", r.MaxSize, r.Arena.Size())
+	}
+
+	if r.profiled() {
+		fmt.Printf("Profile: %v, Peak Held: %v bytes, Allocated: %v bytes, Freed: %v bytes\n", r.Profile.Kind, r.PeakHeld, r.BytesAllocated, r.BytesFreed)
+	}
+
+	status, err := ReadStatus()
+
+	if err != nil {
+		fmt.Printf("Unable to read RSS: %v\n", err)
+	} else {
+		fmt.Printf("RSS: %v bytes, Peak RSS: %v bytes, Swap: %v bytes\n", status.RSS, status.PeakRSS, status.Swap)
+	}
+
+	if r.Cgroup == nil {
+		return
+	}
+
+	memory, err := r.Cgroup.Memory()
+
+	if err != nil {
+		fmt.Printf("Unable to read cgroup memory: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Cgroup %v: %v\n", r.Cgroup.Path, memory)
+
+	events, err := r.Cgroup.Events()
+
+	if err != nil {
+		fmt.Printf("Unable to read cgroup memory events: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Cgroup Memory Events: %v\n", events)
+	fmt.Printf("Cgroup Memory Events During Run: %v\n", cgroup.Events{
+		High:    events.High - r.startEvents.High,
+		Max:     events.Max - r.startEvents.Max,
+		OOM:     events.OOM - r.startEvents.OOM,
+		OOMKill: events.OOMKill - r.startEvents.OOMKill,
+	})
 }
 
 func (r *Replicator) Run() {
 	r.StartTime = time.Now()
 	queue := make(chan *Result, r.MaxWorkers)
-	mutex := sync.Mutex{}
+	r.busy = make([]bool, r.MaxWorkers)
+
+	if r.Cgroup != nil {
+		r.startEvents, _ = r.Cgroup.Events()
+		r.lastEvents = r.startEvents
+	}
+
+	switch {
+	case r.Mode == ModeBandwidth:
+		for worker := int64(0); worker < r.MaxWorkers; worker++ {
+			r.streams = append(r.streams, newStream(r.MaxSize/r.MaxWorkers))
+		}
+
+		r.bandwidth = make(map[string]*benchStats)
+		r.AllocationTime = time.Since(r.StartTime)
+		fmt.Printf("Allocated %v STREAM arrays of %v elements in %v\n", 3*r.MaxWorkers, len(r.streams[0].a), r.AllocationTime)
+	case r.Mode == ModeLatency:
+		r.sets = workingSets(r.MaxSize / r.MaxWorkers)
+		r.latency = make(map[int64]*benchStats)
+		fmt.Printf("Chasing pointers through working sets of %v bytes\n", r.sets)
+	case r.Mode == ModeGC:
+		r.gcStart = readGC()
+		r.liveBytes = make([]int64, r.MaxWorkers)
+
+		for worker := int64(0); worker < r.MaxWorkers; worker++ {
+			go r.churn(worker, queue)
+			r.busy[worker] = true
+			r.CurrentWorkers++
+		}
+	case !r.ReleaseMemory:
+		r.resize()
+		r.AllocationTime = time.Since(r.StartTime)
+		fmt.Printf("Allocated %v bytes in %v\n", r.Arena.Size(), r.AllocationTime)
+		r.printRSS()
+	}
+
 	for {
 		select {
 		case <-r.Context.Done():
 			r.Ticker.Stop()
-			close(queue)
 			return
 		case <-r.Ticker.C:
 
@@ -98,66 +226,54 @@ func (r *Replicator) Run() {
 				fmt.Printf("\tFrees on GC: %v\n", memStatsAfterGC.Frees-memStatsBeforeGC.Frees)
 			}
 
-			if r.CurrentWorkers >= r.MaxWorkers {
+			if r.profiled() {
+				r.resize()
+			}
+
+			r.printRSS()
+			r.printCgroup()
+
+			if r.Mode == ModeGC {
+				r.sampleGC()
+			}
+
+			region := r.MaxSize / r.MaxWorkers
+
+			if !r.ReleaseMemory && r.pressure() {
+				region = r.Arena.Size() / r.MaxWorkers
+			}
+
+			if r.CurrentWorkers >= r.MaxWorkers || region <= 0 {
 				continue
 			}
 
-			maxSize := r.MaxSize / r.MaxWorkers
-
-			start := rand.Int63n(maxSize - 1)
-			size := rand.Int63n(maxSize - start)
-
-			for i := r.CurrentWorkers; i < r.MaxWorkers; i++ {
-				go func(lock *sync.Mutex, size, start int64, release, read bool, results chan<- *Result) {
-					magic := 0
-					duration := time.Duration(0)
-					bytesRead := 0
-					bytesWrote := 0
-					if !release {
-						lock.Lock()
-						startTime := time.Now()
-						for i := int64(0); i < size; i++ {
-							r.RAM[size+i]++
-							bytesWrote += int(unsafe.Sizeof(r.RAM[size+i]))
-						}
-						if read {
-							for i := int64(0); i < size; i++ {
-								magic += r.RAM[start+i]
-								bytesRead += int(unsafe.Sizeof(r.RAM[size+i]))
-							}
-						}
-						duration = time.Since(startTime)
-						lock.Unlock()
-					} else {
-						startTime := time.Now()
-						ram := make([]int, 0)
-
-						for i := start; i < size; i++ {
-							ram = append(ram, int(i))
-							bytesWrote += int(unsafe.Sizeof(ram[i]))
-						}
-						if read {
-							for i := start; i < size; i++ {
-								magic += ram[i]
-								bytesRead += int(unsafe.Sizeof(ram[i]))
-							}
-						}
-						duration = time.Since(startTime)
-					}
-
-					results <- &Result{
-						Error:        nil,
-						MagicNumber:  magic,
-						Duration:     duration,
-						BytesWritten: int64(bytesWrote),
-						BytesRead:    int64(bytesRead),
-					}
-
-				}(&mutex, start, size, r.ReleaseMemory, r.Read, queue)
+			for worker := int64(0); worker < r.MaxWorkers; worker++ {
+				if r.busy[worker] {
+					continue
+				}
+
+				start := rand.Int63n(region)
+				size := rand.Int63n(region-start) + 1
 
+				if r.Mode == ModeLatency {
+					size = r.sets[r.nextSet%len(r.sets)]
+					r.nextSet++
+				}
+
+				go r.work(worker, worker*region+start, size, queue)
+
+				r.busy[worker] = true
 				r.CurrentWorkers++
 			}
 		case result := <-queue:
+			if r.Mode == ModeGC {
+				r.churned(result)
+				continue
+			}
+
+			r.busy[result.Worker] = false
+			r.CurrentWorkers--
+
 			if result.Error != nil {
 				fmt.Printf("Error during Memory Load Test %v\n", result.Error)
 				continue
@@ -167,7 +283,6 @@ func (r *Replicator) Run() {
 			r.BytesRead += uint64(result.BytesRead)
 			r.TimeRunning += result.Duration
 			r.JobsCompleted++
-			r.CurrentWorkers--
 
 			if r.ShortestTime > result.Duration {
 				r.ShortestTime = result.Duration
@@ -177,59 +292,158 @@ func (r *Replicator) Run() {
 				r.LongestTime = result.Duration
 			}
 
+			if r.benchmarking() {
+				r.measured(result)
+				continue
+			}
+
 			fmt.Printf("Wrote: %v, Read: %v, MagicNumber: %v, took: %v\n", result.BytesWritten, result.BytesRead, result.MagicNumber, result.Duration)
 
 		}
 	}
 }
 
-func ParseMemString(memString string) (int64, error) {
-	if len(memString) == 0 {
-		return 0, fmt.Errorf("String was empty")
-	}
-
-	lowerMemString := strings.ToLower(memString)
-
-	mem := int64(0)
-	scale := 0
-	numIndex := 0
-
-	for i := len(lowerMemString) - 1; i >= 0; i-- {
-		char := lowerMemString[i]
-		switch char {
-		case 'e':
-			// scale = exabyte
-			scale = 60
-		case 'p':
-			// scale = petabye
-			scale = 50
-		case 't':
-			// scale = terabyte
-			scale = 40
-		case 'g':
-			// scale = gigabyte
-			scale = 30
-		case 'm':
-			// scale = megabyte
-			scale = 20
-		case 'k':
-			// scale = kilobyte
-			scale = 10
-		case 'b':
-			scale = 0
-		default:
-			num, err := strconv.ParseInt(string(memString[i]), 10, 64)
-			if err != nil {
-				return 0, fmt.Errorf("unable to parse %v as an integer %v", string(char), err)
+// work writes, and optionally reads back, size bytes at start. Workers are
+// handed disjoint ranges of the arena so they never need to lock it
+func (r *Replicator) work(worker, start, size int64, results chan<- *Result) {
+	result := &Result{Worker: worker}
+	startTime := time.Now()
+	arena := &r.Arena
+
+	switch r.Mode {
+	case ModeBandwidth:
+		result.Measurements = r.streams[worker].run()
+		result.Duration = time.Since(startTime)
+		results <- result
+		return
+	case ModeLatency:
+		measurement, end := chase(size)
+		result.Measurements = []Measurement{measurement}
+		result.MagicNumber = end
+		result.Duration = time.Since(startTime)
+		results <- result
+		return
+	}
+
+	if r.ReleaseMemory {
+		arena = &Arena{}
+		arena.Grow(size)
+		start = 0
+	}
+
+	result.BytesWritten = arena.Write(start, size)
+
+	if r.Read {
+		result.MagicNumber, result.BytesRead = arena.Read(start, size)
+	}
+
+	result.Duration = time.Since(startTime)
+	results <- result
+}
+
+// benchmarking is whether the workers run bandwidth or latency benchmarks rather than holding memory
+func (r *Replicator) benchmarking() bool {
+	return r.Mode == ModeBandwidth || r.Mode == ModeLatency
+}
+
+// measured adds up a benchmark job's measurements
+func (r *Replicator) measured(result *Result) {
+	line := make([]string, 0, len(result.Measurements))
+
+	for _, measurement := range result.Measurements {
+		var stats *benchStats
+
+		if r.Mode == ModeBandwidth {
+			if _, ok := r.bandwidth[measurement.Name]; !ok {
+				r.bandwidth[measurement.Name] = &benchStats{}
+			}
+
+			stats = r.bandwidth[measurement.Name]
+		} else {
+			if _, ok := r.latency[measurement.WorkingSet]; !ok {
+				r.latency[measurement.WorkingSet] = &benchStats{}
 			}
-			mem += num * int64(math.Pow10(numIndex))
-			numIndex = numIndex + 1
+
+			stats = r.latency[measurement.WorkingSet]
 		}
+
+		stats.add(result.Worker, measurement)
+		line = append(line, measurement.String())
+	}
+
+	fmt.Printf("Worker %v: %v, took: %v\n", result.Worker, strings.Join(line, ", "), result.Duration)
+}
+
+// pressure is whether the Replicator holds memory rather than benchmarking or making garbage
+func (r *Replicator) pressure() bool {
+	return r.Mode == "" || r.Mode == ModePressure
+}
+
+// profiled is whether the memory held changes over the run
+func (r *Replicator) profiled() bool {
+	return !r.ReleaseMemory && r.pressure() && r.Profile.Kind != "" && r.Profile.Kind != ProfileHold
+}
+
+// resize grows or shrinks the arena to what the profile wants right now,
+// handing freed memory straight back to the OS so RSS follows
+func (r *Replicator) resize() {
+	held := r.Arena.Size()
+	target := r.MaxSize
+
+	if r.profiled() {
+		target = r.Profile.Target(time.Since(r.StartTime), held, r.MaxSize)
+	}
+
+	switch {
+	case target > held:
+		r.Arena.Grow(target - held)
+		r.BytesAllocated += target - held
+	case target < held:
+		r.Arena.Shrink(held - target)
+		r.BytesFreed += held - target
+		debug.FreeOSMemory()
+	}
+
+	if target > r.PeakHeld {
+		r.PeakHeld = target
+	}
+}
+
+// printCgroup reports the cgroup's usage, and any memory events since the last tick
+func (r *Replicator) printCgroup() {
+	if r.Cgroup == nil {
+		return
+	}
+
+	memory, err := r.Cgroup.Memory()
+
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Cgroup: %v\n", memory)
+
+	events, err := r.Cgroup.Events()
+
+	if err != nil || events == r.lastEvents {
+		return
+	}
+
+	fmt.Printf("Cgroup Memory Events: %v\n", events)
+	r.lastEvents = events
+}
+
+func (r *Replicator) printRSS() {
+	status, err := ReadStatus()
+
+	if err != nil {
+		return
 	}
 
-	if scale > 0 {
-		mem *= int64(math.Pow(2, float64(scale)))
+	if !r.pressure() {
+		fmt.Printf("RSS: %v bytes\n", status.RSS)
+		return
 	}
 
-	return mem, nil
+	fmt.Printf("Holding %v bytes, RSS: %v bytes\n", r.Arena.Size(), status.RSS)
 }
@@ -0,0 +1,100 @@
+package mem
+
+import (
+	"fmt"
+	"time"
+)
+
+// Profiles shape how much memory the Replicator holds over time, every
+// profile is bounded by the Replicator's MaxSize
+const (
+	// ProfileHold allocates MaxSize up front and holds it
+	ProfileHold = "hold"
+	// ProfileRamp grows linearly from Start to MaxSize over Period, then holds
+	ProfileRamp = "ramp"
+	// ProfileStep starts at Start and adds Step every StepEvery
+	ProfileStep = "step"
+	// ProfileSawtooth grows from Start to MaxSize over Period, frees back to Start and repeats
+	ProfileSawtooth = "sawtooth"
+	// ProfileLeak starts at Start and adds Step every tick, never releasing anything
+	ProfileLeak = "leak"
+)
+
+// Profile picks how many bytes the Replicator should be holding at any point of the run
+type Profile struct {
+	Kind      string
+	Start     int64
+	Period    time.Duration
+	Step      int64
+	StepEvery time.Duration
+}
+
+// ValidProfile reports whether kind is one of the supported profiles
+func ValidProfile(kind string) bool {
+	switch kind {
+	case ProfileHold, ProfileRamp, ProfileStep, ProfileSawtooth, ProfileLeak:
+		return true
+	}
+
+	return false
+}
+
+// Check makes sure the profile can run up to max bytes
+func (p *Profile) Check(max int64) error {
+	if !ValidProfile(p.Kind) {
+		return fmt.Errorf("Unknown memory profile %v", p.Kind)
+	}
+
+	if p.Kind == ProfileHold {
+		return nil
+	}
+
+	if p.Start < 0 || p.Start > max {
+		return fmt.Errorf("need 0 <= start %v <= max %v", p.Start, max)
+	}
+
+	switch p.Kind {
+	case ProfileRamp, ProfileSawtooth:
+		if p.Period <= 0 {
+			return fmt.Errorf("the %v profile needs a period", p.Kind)
+		}
+	case ProfileStep:
+		if p.Step <= 0 || p.StepEvery <= 0 {
+			return fmt.Errorf("the step profile needs a step size and interval")
+		}
+	case ProfileLeak:
+		if p.Step <= 0 {
+			return fmt.Errorf("the leak profile needs a step size")
+		}
+	}
+
+	return nil
+}
+
+// Target is how many bytes should be held elapsed into the run, given the
+// bytes currently held and the max
+func (p *Profile) Target(elapsed time.Duration, current, max int64) int64 {
+	target := max
+	span := float64(max - p.Start)
+
+	switch p.Kind {
+	case ProfileRamp:
+		target = p.Start + int64(span*float64(elapsed)/float64(p.Period))
+	case ProfileStep:
+		target = p.Start + p.Step*int64(elapsed/p.StepEvery)
+	case ProfileSawtooth:
+		target = p.Start + int64(span*float64(elapsed%p.Period)/float64(p.Period))
+	case ProfileLeak:
+		target = current + p.Step
+
+		if current < p.Start {
+			target = p.Start
+		}
+	}
+
+	if target > max {
+		return max
+	}
+
+	return target
+}
@@ -0,0 +1,75 @@
+package mem
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfileTarget(t *testing.T) {
+	const max = 1000
+
+	ramp := Profile{Kind: ProfileRamp, Start: 200, Period: 10 * time.Second}
+	step := Profile{Kind: ProfileStep, Start: 100, Step: 300, StepEvery: time.Second}
+	sawtooth := Profile{Kind: ProfileSawtooth, Start: 0, Period: 4 * time.Second}
+	leak := Profile{Kind: ProfileLeak, Start: 100, Step: 50}
+
+	tests := []struct {
+		name    string
+		profile Profile
+		elapsed time.Duration
+		current int64
+		want    int64
+	}{
+		{"hold", Profile{Kind: ProfileHold}, 0, 0, max},
+		{"hold later", Profile{Kind: ProfileHold}, time.Hour, 500, max},
+		{"ramp start", ramp, 0, 0, 200},
+		{"ramp halfway", ramp, 5 * time.Second, 0, 600},
+		{"ramp end", ramp, 10 * time.Second, 0, max},
+		{"ramp past the period", ramp, time.Minute, 0, max},
+		{"step start", step, 0, 0, 100},
+		{"step within the first step", step, 999 * time.Millisecond, 0, 100},
+		{"step one", step, time.Second, 0, 400},
+		{"step two", step, 2500 * time.Millisecond, 0, 700},
+		{"step capped", step, 5 * time.Second, 0, max},
+		{"sawtooth start", sawtooth, 0, 0, 0},
+		{"sawtooth quarter", sawtooth, time.Second, 0, 250},
+		{"sawtooth wraps", sawtooth, 4 * time.Second, 0, 0},
+		{"sawtooth second cycle", sawtooth, 7 * time.Second, 0, 750},
+		{"leak below start", leak, 0, 0, 100},
+		{"leak grows", leak, time.Second, 100, 150},
+		{"leak ignores time", leak, time.Hour, 400, 450},
+		{"leak capped", leak, 0, 980, max},
+	}
+
+	for _, test := range tests {
+		if got := test.profile.Target(test.elapsed, test.current, max); got != test.want {
+			t.Errorf("%v: Target(%v, %v, %v) = %v, want %v", test.name, test.elapsed, test.current, max, got, test.want)
+		}
+	}
+}
+
+func TestProfileCheck(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		err     bool
+	}{
+		{Profile{Kind: ProfileHold}, false},
+		{Profile{Kind: ProfileHold, Start: -1}, false},
+		{Profile{Kind: ProfileRamp, Period: time.Second}, false},
+		{Profile{Kind: ProfileRamp}, true},
+		{Profile{Kind: ProfileSawtooth, Start: 2000, Period: time.Second}, true},
+		{Profile{Kind: ProfileStep, Step: 1, StepEvery: time.Second}, false},
+		{Profile{Kind: ProfileStep, Step: 1}, true},
+		{Profile{Kind: ProfileStep, StepEvery: time.Second}, true},
+		{Profile{Kind: ProfileLeak, Step: 1}, false},
+		{Profile{Kind: ProfileLeak, Start: -1, Step: 1}, true},
+		{Profile{Kind: ProfileLeak}, true},
+		{Profile{Kind: "spike"}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.profile.Check(1000); (err != nil) != test.err {
+			t.Errorf("%+v: Check(1000) error = %v, want error %v", test.profile, err, test.err)
+		}
+	}
+}
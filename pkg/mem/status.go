@@ -0,0 +1,91 @@
+package mem
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Status is the memory the kernel reports for this process in /proc/self/status
+type Status struct {
+	// RSS is the resident set size (VmRSS)
+	RSS int64
+	// PeakRSS is the high water mark of RSS (VmHWM)
+	PeakRSS int64
+	// Swap is how much has been swapped out (VmSwap)
+	Swap int64
+}
+
+// ReadStatus reads the process's memory usage out of /proc/self/status
+func ReadStatus() (Status, error) {
+	status := Status{}
+	data, err := ioutil.ReadFile("/proc/self/status")
+
+	if err != nil {
+		return status, err
+	}
+
+	fields := map[string]*int64{
+		"VmRSS":  &status.RSS,
+		"VmHWM":  &status.PeakRSS,
+		"VmSwap": &status.Swap,
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// VmRSS:	  123456 kB
+		parts := strings.Fields(line)
+
+		if len(parts) != 3 || parts[2] != "kB" {
+			continue
+		}
+
+		field, ok := fields[strings.TrimSuffix(parts[0], ":")]
+
+		if !ok {
+			continue
+		}
+
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+
+		if err != nil {
+			return status, fmt.Errorf("unable to parse %v: %v", line, err)
+		}
+
+		*field = value << 10
+	}
+
+	return status, nil
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("%v bytes resident (peak %v), %v bytes swapped", s.RSS, s.PeakRSS, s.Swap)
+}
+
+// TotalMemory reads how much memory the host has out of /proc/meminfo
+func TotalMemory() (int64, error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// MemTotal:       16318508 kB
+		parts := strings.Fields(line)
+
+		if len(parts) != 3 || parts[0] != "MemTotal:" {
+			continue
+		}
+
+		total, err := strconv.ParseInt(parts[1], 10, 64)
+
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse %v: %v", line, err)
+		}
+
+		return total << 10, nil
+	}
+
+	return 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// connectionTrace records how a request got its connection
+type connectionTrace struct {
+	lock         sync.Mutex
+	newConn      bool
+	connectErr   error
+	handshakeErr error
+}
+
+func (t *connectionTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.lock.Lock()
+			t.newConn = !info.Reused
+			t.lock.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err != nil {
+				t.lock.Lock()
+				t.connectErr = err
+				t.lock.Unlock()
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				t.lock.Lock()
+				t.handshakeErr = err
+				t.lock.Unlock()
+			}
+		},
+	}
+}
+
+// apply copies what the trace saw on to a response
+func (t *connectionTrace) apply(response *Response) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	response.NewConnection = t.newConn
+	response.ConnectError = t.connectErr
+	response.HandshakeError = t.handshakeErr
+}
+
+// transport builds the transport for the HTTP based modes, in churn mode
+// every request gets a connection of its own
+func (r *Replicator) transport() *http.Transport {
+	transport := r.Routing.Transport()
+	transport.DisableKeepAlives = r.Churn
+
+	if r.ResumeTLS {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+
+		transport.TLSClientConfig.ClientSessionCache = r.sessionCache
+	}
+
+	return transport
+}
+
+// idle opens a connection to the URL's host and holds it open without
+// sending anything until HoldTime passes, the server hangs up or the run ends
+func (r *Replicator) idle(rawURL string, results chan<- *Response) {
+	response := &Response{URL: rawURL, Event: EventConnect}
+	target, err := url.Parse(rawURL)
+
+	if err != nil {
+		response.Error = err
+		response.Done = true
+		r.report(results, response)
+		return
+	}
+
+	secure := target.Scheme == "https" || target.Scheme == "wss"
+	scheme := "http"
+	port := target.Port()
+
+	if secure {
+		scheme = "https"
+	}
+
+	if port == "" {
+		port = "80"
+
+		if secure {
+			port = "443"
+		}
+	}
+
+	startTime := time.Now()
+	conn, err := r.Routing.DialTunnel(r.Context, scheme, net.JoinHostPort(target.Hostname(), port))
+
+	if err != nil {
+		response.Error = err
+		response.ConnectError = err
+		response.Done = true
+		r.report(results, response)
+		return
+	}
+
+	if secure {
+		config := r.Routing.TLSConfig(target.Hostname())
+
+		if r.ResumeTLS {
+			config.ClientSessionCache = r.sessionCache
+		}
+
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			response.Error = err
+			response.HandshakeError = err
+			response.Done = true
+			r.report(results, response)
+			return
+		}
+
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	response.Duration = time.Since(startTime)
+	response.NewConnection = true
+	r.report(results, response)
+
+	closed := make(chan error, 1)
+
+	go func() {
+		// Nothing is sent so anything coming back means the server gave up on us
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	var hold <-chan time.Time
+
+	if r.HoldTime > 0 {
+		timer := time.NewTimer(r.HoldTime)
+		defer timer.Stop()
+		hold = timer.C
+	}
+
+	select {
+	case <-r.Context.Done():
+		conn.Close()
+	case <-hold:
+		conn.Close()
+		r.report(results, &Response{URL: rawURL, Event: EventDisconnect, Done: true})
+	case err := <-closed:
+		conn.Close()
+		r.report(results, &Response{URL: rawURL, Event: EventDisconnect, Error: err, Done: true})
+	}
+}
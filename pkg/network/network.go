@@ -2,11 +2,38 @@ package network
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
+	"text/template"
 	"time"
+
+	"github.com/alyssadaemon/troll/pkg/stats"
+)
+
+const (
+	// ModeHTTP makes one GET per worker and then lets the worker finish
+	ModeHTTP = "http"
+	// ModeWebSocket keeps a long lived websocket per worker sending messages
+	ModeWebSocket = "websocket"
+	// ModeStream keeps a streaming response open per worker consuming events
+	ModeStream = "stream"
+	// ModeIdle opens a connection per worker and holds it open doing nothing
+	ModeIdle = "idle"
+)
+
+const (
+	EventRequest    = "request"
+	EventConnect    = "connect"
+	EventSent       = "sent"
+	EventMessage    = "message"
+	EventStream     = "event"
+	EventDisconnect = "disconnect"
 )
 
 type Response struct {
@@ -14,6 +41,16 @@ type Response struct {
 	Error    error
 	Status   int
 	Duration time.Duration
+	Event    string
+	// Done is set on the last response a worker sends before exiting
+	Done bool
+	// EventID and First are only set for stream events
+	EventID string
+	First   bool
+	// NewConnection is set when a new connection was opened for the call
+	NewConnection  bool
+	ConnectError   error
+	HandshakeError error
 }
 
 type Replicator struct {
@@ -30,6 +67,34 @@ type Replicator struct {
 	TimeRunning         time.Duration
 	ShortestTime        time.Duration
 	LongestTime         time.Duration
+	Routing             *Routing
+	Mode                string
+	MessageInterval     time.Duration
+	Payload             *template.Template
+	Connects            int64
+	ConnectErrors       int64
+	Reconnects          int64
+	Disconnects         int64
+	MessagesSent        int64
+	MessagesReceived    int64
+	UnmatchedMessages   int64
+	ConnectTime         stats.Latency
+	StreamFormat        string
+	EventsReceived      int64
+	FirstEventTime      stats.Latency
+	EventGap            stats.Latency
+	Churn               bool
+	ResumeTLS           bool
+	HoldTime            time.Duration
+	NewConnections      int64
+	ReusedConnections   int64
+	ConnectFailures     int64
+	HandshakeFailures   int64
+	PeakConnections     int64
+	client              *http.Client
+	sessionCache        tls.ClientSessionCache
+	workersStarted      int64
+	lastEventIDs        map[string]string
 }
 
 func (r *Replicator) Stats() {
@@ -62,71 +127,272 @@ func (r *Replicator) Stats() {
 		}
 	}
 
+	if r.Mode == ModeHTTP || r.Mode == ModeIdle {
+		newPerSecond := float64(0)
+
+		if totalTime.Seconds() > 0 {
+			newPerSecond = float64(r.NewConnections) / totalTime.Seconds()
+		}
+
+		fmt.Println("Connection Stats:")
+		fmt.Printf("\tNew Connections: %v (%.2f/sec), Reused: %v\n", r.NewConnections, newPerSecond, r.ReusedConnections)
+		fmt.Printf("\tConnect Failures: %v, TLS Handshake Failures: %v\n", r.ConnectFailures, r.HandshakeFailures)
+	}
+
+	if r.Mode == ModeIdle {
+		fmt.Printf("\tPeak Open Connections: %v, Disconnects: %v\n", r.PeakConnections, r.Disconnects)
+		fmt.Printf("\tConnect Time: %v (also reported as the response times above)\n", &r.ConnectTime)
+	}
+
+	if r.Mode == ModeWebSocket {
+		fmt.Println("WebSocket Stats:")
+		fmt.Printf("\tConnections: %v (%v failed)\n", r.Connects, r.ConnectErrors)
+		fmt.Printf("\tReconnects: %v, Disconnects: %v\n", r.Reconnects, r.Disconnects)
+		fmt.Printf("\tConnect Time: %v\n", &r.ConnectTime)
+		fmt.Printf("\tMessages Sent: %v, Received: %v (%v unmatched)\n", r.MessagesSent, r.MessagesReceived, r.UnmatchedMessages)
+		fmt.Println("\tRound trip times are reported as the response times above")
+	}
+
+	if r.Mode == ModeStream {
+		fmt.Println("Stream Stats:")
+		fmt.Printf("\tStreams Opened: %v (%v failed)\n", r.Connects, r.ConnectErrors)
+		fmt.Printf("\tReconnects: %v, Disconnects: %v\n", r.Reconnects, r.Disconnects)
+		fmt.Printf("\tEvents Received: %v\n", r.EventsReceived)
+		fmt.Printf("\tTime To First Event: %v\n", &r.FirstEventTime)
+		fmt.Printf("\tGap Between Events: %v\n", &r.EventGap)
+		fmt.Println("\tTime to response headers is reported as the response times above")
+	}
+
 }
 
 func (r *Replicator) Run() {
 	r.StartTime = time.Now()
 	results := make(chan *Response, r.MaxWorkers)
+	if r.ResumeTLS {
+		r.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	r.client = &http.Client{Transport: r.transport()}
+	r.lastEventIDs = make(map[string]string)
 
 	for {
 		select {
 		case <-r.Context.Done():
 			return
 		case result := <-results:
-			if result.Error != nil {
-				fmt.Println(result.Error)
-				r.ErrorCallsMade++
-			} else {
-				r.SuccessfulCallsMade++
-
-				fmt.Printf("%v: %v %v\n", result.Status, result.URL, result.Duration)
-
-				if _, ok := r.StatusStats[result.Status]; !ok {
-					r.StatusStats[result.Status] = 0
-				}
-				r.StatusStats[result.Status]++
-
-				r.TimeRunning += result.Duration
-				if r.ShortestTime > result.Duration {
-					r.ShortestTime = result.Duration
-				}
+			switch result.Event {
+			case EventConnect, EventSent, EventMessage, EventStream, EventDisconnect:
+				r.recordConnection(result)
+			default:
+				r.recordRequest(result)
+			}
 
-				if r.LongestTime < result.Duration {
-					r.LongestTime = result.Duration
-				}
+			if result.Done {
+				r.CurrentWorkers--
 			}
-			r.CurrentWorkers--
 		case <-r.Ticker.C:
 			if r.CurrentWorkers >= r.MaxWorkers {
 				continue
 			}
 			for r.MaxWorkers > r.CurrentWorkers {
-				go func(url string, sleep int64, done chan<- *Response) {
-					if sleep > 0 {
-						time.Sleep(time.Duration(rand.Int63n(sleep)) * time.Millisecond)
+				url := r.URLs[rand.Intn(len(r.URLs))]
+
+				switch r.Mode {
+				case ModeWebSocket:
+					if r.workersStarted >= r.MaxWorkers {
+						r.Reconnects++
 					}
-					startTime := time.Now()
-					resp, err := http.Get(url)
-					httpDuration := time.Since(startTime)
-					status := 0
-
-					if err == nil {
-						defer resp.Body.Close()
-						status = resp.StatusCode
+					go r.webSocket(url, results)
+				case ModeStream:
+					if r.workersStarted >= r.MaxWorkers {
+						r.Reconnects++
 					}
-
-					response := &Response{
-						URL:      url,
-						Duration: httpDuration,
-						Error:    err,
-						Status:   status,
+					go r.stream(url, r.lastEventIDs[url], results)
+				case ModeIdle:
+					if r.workersStarted >= r.MaxWorkers {
+						r.Reconnects++
 					}
+					go r.idle(url, results)
+				default:
+					go r.call(url, r.WorkerSleep, results)
+				}
 
-					done <- response
-
-				}(r.URLs[rand.Intn(len(r.URLs))], r.WorkerSleep, results)
+				r.workersStarted++
 				r.CurrentWorkers++
 			}
 		}
 	}
 }
+
+func (r *Replicator) recordRequest(result *Response) {
+	r.recordTrace(result)
+
+	if result.Error != nil {
+		fmt.Println(result.Error)
+		r.ErrorCallsMade++
+		return
+	}
+
+	r.SuccessfulCallsMade++
+
+	fmt.Printf("%v: %v %v\n", result.Status, result.URL, result.Duration)
+
+	if _, ok := r.StatusStats[result.Status]; !ok {
+		r.StatusStats[result.Status] = 0
+	}
+	r.StatusStats[result.Status]++
+
+	r.recordDuration(result.Duration)
+}
+
+func (r *Replicator) recordDuration(duration time.Duration) {
+	r.TimeRunning += duration
+	if r.ShortestTime > duration {
+		r.ShortestTime = duration
+	}
+
+	if r.LongestTime < duration {
+		r.LongestTime = duration
+	}
+}
+
+// recordTrace tallies how a call got its connection
+func (r *Replicator) recordTrace(result *Response) {
+	if result.NewConnection {
+		r.NewConnections++
+	} else if result.Error == nil {
+		r.ReusedConnections++
+	}
+
+	if result.ConnectError != nil {
+		r.ConnectFailures++
+	}
+
+	if result.HandshakeError != nil {
+		r.HandshakeFailures++
+	}
+}
+
+func (r *Replicator) recordConnection(result *Response) {
+	switch result.Event {
+	case EventConnect:
+		if r.Mode == ModeIdle {
+			r.recordTrace(result)
+		}
+
+		if result.Error != nil {
+			fmt.Printf("Unable to connect to %v: %v\n", result.URL, result.Error)
+			r.ConnectErrors++
+			r.ErrorCallsMade++
+			return
+		}
+
+		if result.Status != 0 {
+			r.recordRequest(result)
+		} else {
+			fmt.Printf("connected: %v %v\n", result.URL, result.Duration)
+		}
+
+		if r.Mode == ModeIdle {
+			r.SuccessfulCallsMade++
+			r.recordDuration(result.Duration)
+		}
+
+		r.Connects++
+		r.ConnectTime.Add(result.Duration)
+
+		if open := r.Connects - r.Disconnects; open > r.PeakConnections {
+			r.PeakConnections = open
+		}
+	case EventSent:
+		if result.Error != nil {
+			r.ErrorCallsMade++
+			return
+		}
+
+		r.MessagesSent++
+	case EventMessage:
+		r.MessagesReceived++
+
+		if result.Duration == 0 {
+			r.UnmatchedMessages++
+			return
+		}
+
+		fmt.Printf("message: %v %v\n", result.URL, result.Duration)
+		r.SuccessfulCallsMade++
+		r.recordDuration(result.Duration)
+	case EventStream:
+		r.EventsReceived++
+
+		if result.EventID != "" {
+			r.lastEventIDs[result.URL] = result.EventID
+		}
+
+		if result.First {
+			r.FirstEventTime.Add(result.Duration)
+		} else {
+			r.EventGap.Add(result.Duration)
+		}
+
+		fmt.Printf("event: %v %v %v\n", result.URL, result.EventID, result.Duration)
+	case EventDisconnect:
+		if result.Error != nil {
+			fmt.Printf("disconnected: %v %v\n", result.URL, result.Error)
+		} else {
+			fmt.Printf("disconnected: %v\n", result.URL)
+		}
+		r.Disconnects++
+	}
+}
+
+// report hands a response to the Run loop unless the run is already over
+func (r *Replicator) report(results chan<- *Response, response *Response) {
+	select {
+	case results <- response:
+	case <-r.Context.Done():
+	}
+}
+
+func (r *Replicator) call(url string, sleep int64, done chan<- *Response) {
+	if sleep > 0 {
+		time.Sleep(time.Duration(rand.Int63n(sleep)) * time.Millisecond)
+	}
+	startTime := time.Now()
+	trace := &connectionTrace{}
+	resp, err := r.get(url, trace)
+	httpDuration := time.Since(startTime)
+	status := 0
+
+	if err == nil {
+		// Connections only go back to the idle pool once the body is read to the end
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		status = resp.StatusCode
+	}
+
+	response := &Response{
+		URL:      url,
+		Duration: httpDuration,
+		Error:    err,
+		Status:   status,
+		Event:    EventRequest,
+		Done:     true,
+	}
+
+	trace.apply(response)
+
+	r.report(done, response)
+}
+
+func (r *Replicator) get(url string, trace *connectionTrace) (*http.Response, error) {
+	req, err := r.Routing.NewRequest(r.Context, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+
+	return r.client.Do(req)
+}
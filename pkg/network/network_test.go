@@ -0,0 +1,34 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCallReusesConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, strings.Repeat("body ", 1<<20))
+	}))
+	defer server.Close()
+
+	r := &Replicator{Context: context.Background(), Routing: &Routing{}}
+	r.client = &http.Client{Transport: r.transport()}
+	results := make(chan *Response, 1)
+
+	for i := 0; i < 3; i++ {
+		r.call(server.URL, 0, results)
+		response := <-results
+
+		if response.Error != nil || response.Status != http.StatusOK {
+			t.Fatalf("call %v: status %v, error %v", i, response.Status, response.Error)
+		}
+
+		if response.NewConnection != (i == 0) {
+			t.Errorf("call %v: new connection %v, want %v", i, response.NewConnection, i == 0)
+		}
+	}
+}
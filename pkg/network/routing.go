@@ -0,0 +1,158 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Routing overrides how requests find their way to a server instead of
+// relying on the environment defaults
+type Routing struct {
+	// Proxy is an http, https or socks5 proxy URL, nil uses HTTP_PROXY and friends
+	Proxy *url.URL
+	// Resolve maps a "host:port" to the "ip:port" that should be dialed instead
+	Resolve map[string]string
+	// DNSServer is a "host:port" to send DNS queries to instead of the system resolver
+	DNSServer string
+	// Host overrides the Host header sent with each request
+	Host string
+	// ServerName overrides the SNI sent during the TLS handshake
+	ServerName string
+}
+
+// ParseResolve parses curl style "host:port:ip" overrides seperated by commas
+func ParseResolve(resolve string) (map[string]string, error) {
+	overrides := make(map[string]string)
+
+	for _, entry := range strings.Split(resolve, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+
+		if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid resolve entry %v, expected host:port:ip", entry)
+		}
+
+		ip := strings.Trim(parts[2], "[]")
+
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address %v in resolve entry %v", parts[2], entry)
+		}
+
+		overrides[net.JoinHostPort(parts[0], parts[1])] = net.JoinHostPort(ip, parts[1])
+	}
+
+	return overrides, nil
+}
+
+// ParseProxy parses a proxy URL, only http, https and socks5 are supported
+func ParseProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %v, expected http, https or socks5", proxyURL.Scheme)
+	}
+
+	if len(proxyURL.Host) == 0 {
+		return nil, fmt.Errorf("proxy %v is missing a host", proxy)
+	}
+
+	return proxyURL, nil
+}
+
+// DialContext dials addr honoring the Resolve overrides and DNSServer
+func (r *Routing) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if r == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if override, ok := r.Resolve[addr]; ok {
+		addr = override
+	}
+
+	if r.DNSServer != "" {
+		server := r.DNSServer
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// TLSConfig returns the TLS config to use when talking to host
+func (r *Routing) TLSConfig(host string) *tls.Config {
+	config := &tls.Config{ServerName: host}
+
+	if r != nil && r.ServerName != "" {
+		config.ServerName = r.ServerName
+	}
+
+	return config
+}
+
+// Transport builds an http.Transport that follows the routing rules
+func (r *Routing) Transport() *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           r.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if r == nil {
+		return transport
+	}
+
+	if r.Proxy != nil {
+		transport.Proxy = http.ProxyURL(r.Proxy)
+	}
+
+	if r.ServerName != "" {
+		transport.TLSClientConfig = &tls.Config{ServerName: r.ServerName}
+	}
+
+	return transport
+}
+
+// NewRequest creates a GET request for url with the Host override applied
+func (r *Routing) NewRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r != nil && r.Host != "" {
+		req.Host = r.Host
+	}
+
+	return req.WithContext(ctx), nil
+}
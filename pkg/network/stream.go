@@ -0,0 +1,136 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// StreamSSE parses the response as text/event-stream
+	StreamSSE = "sse"
+	// StreamLines treats every line of the response as an event, this covers
+	// NDJSON, chunked line protocols and long polling
+	StreamLines = "lines"
+)
+
+func (r *Replicator) stream(url, lastEventID string, results chan<- *Response) {
+	req, err := r.Routing.NewRequest(r.Context, url)
+
+	if err != nil {
+		r.report(results, &Response{URL: url, Event: EventConnect, Error: err, Done: true})
+		return
+	}
+
+	if r.StreamFormat == StreamSSE {
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Cache-Control", "no-cache")
+
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+	}
+
+	startTime := time.Now()
+	resp, err := r.client.Do(req)
+
+	if err != nil {
+		r.report(results, &Response{URL: url, Event: EventConnect, Error: err, Done: true})
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("stream returned %v", resp.Status)
+		r.report(results, &Response{URL: url, Event: EventConnect, Status: resp.StatusCode, Error: err, Done: true})
+		return
+	}
+
+	r.report(results, &Response{URL: url, Event: EventConnect, Status: resp.StatusCode, Duration: time.Since(startTime)})
+
+	reader := bufio.NewReader(resp.Body)
+	lastEvent := startTime
+	first := true
+
+	emit := func(id string) {
+		now := time.Now()
+		r.report(results, &Response{URL: url, Event: EventStream, Duration: now.Sub(lastEvent), EventID: id, First: first})
+		lastEvent = now
+		first = false
+	}
+
+	parser := sseParser{id: lastEventID}
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF {
+				err = nil
+			}
+
+			r.report(results, &Response{URL: url, Event: EventDisconnect, Error: err, Done: true})
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if r.StreamFormat != StreamSSE {
+			if len(strings.TrimSpace(line)) > 0 {
+				emit("")
+			}
+			continue
+		}
+
+		if parser.line(line) {
+			emit(parser.id)
+		}
+	}
+}
+
+// sseParser follows the text/event-stream format line by line, only
+// tracking what's needed to count events and resume the stream
+type sseParser struct {
+	// id is the last event ID seen, it carries over between events
+	id   string
+	data bool
+}
+
+// line feeds the parser one line without its line ending, returning true
+// when the line dispatches an event
+func (p *sseParser) line(line string) bool {
+	if len(line) == 0 {
+		// A blank line dispatches whatever has been gathered so far
+		dispatch := p.data
+		p.data = false
+		return dispatch
+	}
+
+	if strings.HasPrefix(line, ":") {
+		// Comments are used as keep alives, they aren't events
+		return false
+	}
+
+	// The field name runs up to the first colon, or is the whole line, and a
+	// single space after the colon isn't part of the value
+	field, value := line, ""
+
+	if i := strings.Index(line, ":"); i >= 0 {
+		field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+	}
+
+	switch field {
+	case "data":
+		p.data = true
+	case "id":
+		// IDs with a NUL in them are ignored
+		if !strings.Contains(value, "\x00") {
+			p.id = value
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSSEParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		lastID string
+		// events is the last event ID at each dispatch
+		events []string
+	}{
+		{"single event", "data: hello\n\n", "", []string{""}},
+		{"multi line data", "data: a\ndata: b\n\n", "", []string{""}},
+		{"field without colon", "data\n\n", "", []string{""}},
+		{"ids", "id: 1\ndata: a\n\nid:2\ndata: b\n\n", "", []string{"1", "2"}},
+		{"id carries over", "id: 1\ndata: a\n\ndata: b\n\n", "", []string{"1", "1"}},
+		{"id resumes from Last-Event-ID", "data: a\n\n", "7", []string{"7"}},
+		{"empty id resets", "id: 1\ndata: a\n\nid\ndata: b\n\n", "", []string{"1", ""}},
+		{"id with NUL ignored", "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n", "", []string{"1", "1"}},
+		{"only one leading space is stripped", "id:  1\ndata: a\n\n", "", []string{" 1"}},
+		{"comments aren't events", ": keep alive\n\n: again\n\n", "", nil},
+		{"blank lines without data", "\n\nevent: ping\n\n", "", nil},
+		{"no dispatch without blank line", "data: a\n", "", nil},
+		{"dataset isn't data", "dataset: a\n\n", "", nil},
+		{"identity isn't id", "identity: x\ndata: a\n\n", "", []string{""}},
+		{"data: in a value", "event: data: x\n\n", "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := sseParser{id: test.lastID}
+			var events []string
+
+			for _, line := range strings.Split(strings.TrimSuffix(test.stream, "\n"), "\n") {
+				if parser.line(line) {
+					events = append(events, parser.id)
+				}
+			}
+
+			if !reflect.DeepEqual(events, test.events) {
+				t.Errorf("events = %q, want %q", events, test.events)
+			}
+		})
+	}
+}
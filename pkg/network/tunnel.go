@@ -0,0 +1,255 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// proxyFor picks the proxy a request to scheme://addr goes through, the
+// Proxy override or otherwise HTTP_PROXY and friends. nil means dial directly
+func (r *Routing) proxyFor(scheme, addr string) (*url.URL, error) {
+	if r != nil && r.Proxy != nil {
+		return r.Proxy, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+addr, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// DialTunnel dials addr the way a request to scheme://addr would be sent,
+// tunnelling through the proxy with HTTP CONNECT for http and https proxies
+// and a SOCKS5 CONNECT for socks5 ones. Without a proxy it's DialContext
+func (r *Routing) DialTunnel(ctx context.Context, scheme, addr string) (net.Conn, error) {
+	proxy, err := r.proxyFor(scheme, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy == nil {
+		return r.DialContext(ctx, "tcp", addr)
+	}
+
+	port := proxy.Port()
+
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxy.Scheme]
+	}
+
+	conn, err := r.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	switch proxy.Scheme {
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+
+		if err = tlsConn.Handshake(); err == nil {
+			conn = tlsConn
+			err = httpConnect(conn, proxy, addr)
+		}
+	case "http":
+		err = httpConnect(conn, proxy, addr)
+	case "socks5":
+		err = socksConnect(conn, proxy, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %v", proxy.Scheme)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tunnel to %v through proxy %v failed: %v", addr, proxy.Host, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr over conn
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Read byte by byte so nothing the server sends after the tunnel opens
+	// gets stuck in a buffer
+	resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), req)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy returned %v", resp.Status)
+	}
+
+	return nil
+}
+
+// byteReader reads a byte at a time so a bufio.Reader on top of it never
+// reads past what it's asked for
+type byteReader struct {
+	reader io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return b.reader.Read(p[:1])
+}
+
+// socksConnect asks a SOCKS5 proxy to open a tunnel to addr over conn, with
+// username and password authentication when the proxy URL has them (RFC 1928, RFC 1929)
+func socksConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+
+	if err != nil {
+		return err
+	}
+
+	method := byte(0x00)
+
+	if proxy.User != nil {
+		method = 0x02
+	}
+
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != 0x05 || reply[1] != method {
+		return fmt.Errorf("socks5 proxy refused authentication method %v", method)
+	}
+
+	if method == 0x02 {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("socks5 username and password must be under 256 bytes")
+		}
+
+		auth := append([]byte{0x01, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+
+		if reply[1] != 0x00 {
+			return fmt.Errorf("socks5 proxy rejected the username and password")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, 0x01), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host %v is too long for socks5", host)
+		}
+
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks5 proxy failed to connect with code %v", header[1])
+	}
+
+	// Skip the address the proxy bound to, then the port
+	skip := 0
+
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("socks5 proxy replied with unknown address type %v", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+
+	return err
+}
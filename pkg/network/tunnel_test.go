@@ -0,0 +1,223 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// echoServer accepts connections and echoes back whatever it's sent
+func echoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// connectProxy is an HTTP proxy that only understands CONNECT, it records
+// the targets it was asked for and the Proxy-Authorization sent
+func connectProxy(t *testing.T, targets chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+
+				if err != nil || req.Method != http.MethodConnect {
+					io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+					return
+				}
+
+				targets <- req.Host + " " + req.Header.Get("Proxy-Authorization")
+				upstream, err := net.Dial("tcp", req.Host)
+
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// socksProxy is a SOCKS5 proxy accepting no authentication or any username and password
+func socksProxy(t *testing.T, targets chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 3)
+				io.ReadFull(conn, greeting)
+				conn.Write([]byte{0x05, greeting[2]})
+				user := ""
+
+				if greeting[2] == 0x02 {
+					length := make([]byte, 2)
+					io.ReadFull(conn, length)
+					name := make([]byte, length[1])
+					io.ReadFull(conn, name)
+					io.ReadFull(conn, length[:1])
+					io.ReadFull(conn, make([]byte, length[0]))
+					conn.Write([]byte{0x01, 0x00})
+					user = string(name)
+				}
+
+				header := make([]byte, 4)
+				io.ReadFull(conn, header)
+				host := ""
+
+				switch header[3] {
+				case 0x01:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 0x03:
+					length := make([]byte, 1)
+					io.ReadFull(conn, length)
+					name := make([]byte, length[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+				addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+				targets <- addr + " " + user
+
+				upstream, err := net.Dial("tcp", addr)
+
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+
+				defer upstream.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestDialTunnel(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	targets := make(chan string, 1)
+	httpProxy := connectProxy(t, targets)
+	defer httpProxy.Close()
+	socks := socksProxy(t, targets)
+	defer socks.Close()
+
+	tests := []struct {
+		name   string
+		proxy  string
+		target string
+	}{
+		{"http", "http://" + httpProxy.Addr().String(), echo.Addr().String() + " "},
+		{"http with credentials", "http://user:secret@" + httpProxy.Addr().String(), echo.Addr().String() + " Basic dXNlcjpzZWNyZXQ="},
+		{"socks5", "socks5://" + socks.Addr().String(), echo.Addr().String() + " "},
+		{"socks5 with credentials", "socks5://user:secret@" + socks.Addr().String(), echo.Addr().String() + " user"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, err := ParseProxy(test.proxy)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routing := &Routing{Proxy: proxy}
+			conn, err := routing.DialTunnel(context.Background(), "http", echo.Addr().String())
+
+			if err != nil {
+				t.Fatalf("DialTunnel: %v", err)
+			}
+
+			defer conn.Close()
+
+			if target := <-targets; target != test.target {
+				t.Errorf("proxy was asked for %q, want %q", target, test.target)
+			}
+
+			io.WriteString(conn, "ping")
+			reply := make([]byte, 4)
+
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+				t.Errorf("echo through the tunnel = %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+func TestDialTunnelRefused(t *testing.T) {
+	targets := make(chan string, 1)
+	httpProxy := connectProxy(t, targets)
+	defer httpProxy.Close()
+
+	proxy, _ := ParseProxy("http://" + httpProxy.Addr().String())
+	routing := &Routing{Proxy: proxy}
+
+	// Nothing listens on port 1 so the proxy answers 502
+	if _, err := routing.DialTunnel(context.Background(), "http", "127.0.0.1:1"); err == nil {
+		t.Errorf("expected an error when the proxy can't connect")
+	}
+}
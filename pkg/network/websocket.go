@@ -0,0 +1,397 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsMaxMessage = 16 << 20
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWebSocketClosed = errors.New("websocket closed by server")
+
+// wsConn is a minimal RFC 6455 client connection, just enough to send text
+// messages and read whatever comes back
+type wsConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func dialWebSocket(ctx context.Context, routing *Routing, rawURL string) (*wsConn, error) {
+	target, err := url.Parse(rawURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	secure := false
+	port := "80"
+
+	switch target.Scheme {
+	case "ws", "http":
+		target.Scheme = "http"
+	case "wss", "https":
+		target.Scheme = "https"
+		secure = true
+		port = "443"
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %v", target.Scheme)
+	}
+
+	if target.Port() != "" {
+		port = target.Port()
+	}
+
+	conn, err := routing.DialTunnel(ctx, target.Scheme, net.JoinHostPort(target.Hostname(), port))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	if secure {
+		tlsConn := tls.Client(conn, routing.TLSConfig(target.Hostname()))
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := routing.NewRequest(ctx, target.String())
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %v failed with status %v", rawURL, resp.Status)
+	}
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %v returned an invalid accept key", rawURL)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &wsConn{conn: conn, reader: reader}, nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+
+	length := len(payload)
+
+	switch {
+	case length < 126:
+		header[1] = 0x80 | byte(length)
+	case length <= 0xFFFF:
+		header[1] = 0x80 | 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 0x80 | 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	mask := make([]byte, 4)
+
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+
+	frame := append(header, mask...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := ws.conn.Write(frame)
+
+	return err
+}
+
+// WriteText sends payload as a single text message
+func (ws *wsConn) WriteText(payload []byte) error {
+	return ws.writeFrame(wsText, payload)
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// stitching fragmented messages back together along the way
+func (ws *wsConn) ReadMessage() ([]byte, error) {
+	message := make([]byte, 0)
+
+	for {
+		header := make([]byte, 2)
+
+		if _, err := io.ReadFull(ws.reader, header); err != nil {
+			return nil, err
+		}
+
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(ws.reader, extended); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err := io.ReadFull(ws.reader, extended); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(extended)
+		}
+
+		if length > wsMaxMessage || uint64(len(message))+length > wsMaxMessage {
+			return nil, fmt.Errorf("websocket message larger than %v bytes", wsMaxMessage)
+		}
+
+		mask := make([]byte, 4)
+
+		if masked {
+			if _, err := io.ReadFull(ws.reader, mask); err != nil {
+				return nil, err
+			}
+		}
+
+		payload := make([]byte, length)
+
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return nil, err
+		}
+
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			return nil, errWebSocketClosed
+		case wsText, wsBinary, wsContinuation:
+			message = append(message, payload...)
+
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %v", opcode)
+		}
+	}
+}
+
+// Close sends a normal closure frame and closes the underlying connection
+func (ws *wsConn) Close() error {
+	ws.writeFrame(wsClose, []byte{0x03, 0xE8})
+	return ws.conn.Close()
+}
+
+// MessageData is what payload templates are rendered with, ID is unique per
+// message and is used to match replies back to the message that caused them
+type MessageData struct {
+	ID   string
+	Seq  int64
+	Time time.Time
+}
+
+type pendingMessage struct {
+	id     string
+	sentAt time.Time
+}
+
+// maxPending caps how many unanswered messages a connection remembers
+const maxPending = 1024
+
+func (r *Replicator) webSocket(url string, results chan<- *Response) {
+	startTime := time.Now()
+	ws, err := dialWebSocket(r.Context, r.Routing, url)
+
+	if err != nil {
+		r.report(results, &Response{URL: url, Event: EventConnect, Error: err, Done: true})
+		return
+	}
+
+	r.report(results, &Response{URL: url, Event: EventConnect, Duration: time.Since(startTime)})
+
+	lock := sync.Mutex{}
+	pending := make([]pendingMessage, 0)
+	readErr := make(chan error, 1)
+
+	go func() {
+		for {
+			message, err := ws.ReadMessage()
+
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			receivedAt := time.Now()
+			rtt := time.Duration(0)
+
+			lock.Lock()
+			for i, p := range pending {
+				if (p.id != "" && strings.Contains(string(message), p.id)) || (p.id == "" && i == 0) {
+					rtt = receivedAt.Sub(p.sentAt)
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+			lock.Unlock()
+
+			r.report(results, &Response{URL: url, Event: EventMessage, Duration: rtt})
+		}
+	}()
+
+	interval := r.MessageInterval
+
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	seq := int64(0)
+
+	for {
+		select {
+		case <-r.Context.Done():
+			ws.Close()
+			return
+		case err := <-readErr:
+			ws.Close()
+			r.report(results, &Response{URL: url, Event: EventDisconnect, Error: err, Done: true})
+			return
+		case <-ticker.C:
+			id, err := uuid.NewRandom()
+
+			if err != nil {
+				r.report(results, &Response{URL: url, Event: EventSent, Error: err})
+				continue
+			}
+
+			seq++
+			data := MessageData{ID: id.String(), Seq: seq, Time: time.Now()}
+			payload := strings.Builder{}
+
+			if r.Payload != nil {
+				err = r.Payload.Execute(&payload, data)
+			} else {
+				_, err = payload.WriteString(data.ID)
+			}
+
+			if err != nil {
+				r.report(results, &Response{URL: url, Event: EventSent, Error: err})
+				continue
+			}
+
+			message := pendingMessage{sentAt: time.Now()}
+
+			if strings.Contains(payload.String(), data.ID) {
+				message.id = data.ID
+			}
+
+			lock.Lock()
+			pending = append(pending, message)
+			if len(pending) > maxPending {
+				pending = pending[1:]
+			}
+			lock.Unlock()
+
+			err = ws.WriteText([]byte(payload.String()))
+
+			r.report(results, &Response{URL: url, Event: EventSent, Error: err})
+
+			if err != nil {
+				ws.conn.Close()
+				<-readErr
+				r.report(results, &Response{URL: url, Event: EventDisconnect, Error: err, Done: true})
+				return
+			}
+		}
+	}
+}
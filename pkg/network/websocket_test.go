@@ -0,0 +1,245 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// serverFrame builds an unmasked frame the way a server sends them
+func serverFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := []byte{opcode, 0}
+
+	if fin {
+		frame[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	return append(frame, payload...)
+}
+
+// readClientFrame reads a masked client frame and returns its opcode and unmasked payload
+func readClientFrame(t *testing.T, reader io.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("reading frame header: %v", err)
+	}
+
+	if header[0]&0x80 == 0 {
+		t.Errorf("client frames should have FIN set")
+	}
+
+	if header[1]&0x80 == 0 {
+		t.Fatalf("client frames must be masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		io.ReadFull(reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		io.ReadFull(reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	mask := make([]byte, 4)
+	io.ReadFull(reader, mask)
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("reading frame payload: %v", err)
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return header[0] & 0x0F, payload
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+	}{
+		{"empty", 0},
+		{"short", 125},
+		{"16 bit length", 126},
+		{"16 bit max", 0xFFFF},
+		{"64 bit length", 0x10000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			ws := &wsConn{conn: client}
+			payload := bytes.Repeat([]byte("a"), test.length)
+			errs := make(chan error, 1)
+
+			go func() {
+				errs <- ws.WriteText(payload)
+			}()
+
+			opcode, got := readClientFrame(t, server)
+
+			if err := <-errs; err != nil {
+				t.Fatalf("WriteText: %v", err)
+			}
+
+			if opcode != wsText {
+				t.Errorf("opcode = %v, want %v", opcode, wsText)
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Errorf("payload of %v bytes came back as %v bytes", len(payload), len(got))
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("b"), 70000)
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []byte
+		pongs  int
+		err    error
+	}{
+		{
+			name:   "text",
+			frames: [][]byte{serverFrame(true, wsText, []byte("hello"))},
+			want:   []byte("hello"),
+		},
+		{
+			name:   "binary with a 64 bit length",
+			frames: [][]byte{serverFrame(true, wsBinary, long)},
+			want:   long,
+		},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				serverFrame(false, wsText, []byte("hel")),
+				serverFrame(false, wsContinuation, []byte("lo ")),
+				serverFrame(true, wsContinuation, []byte("world")),
+			},
+			want: []byte("hello world"),
+		},
+		{
+			name: "ping between fragments",
+			frames: [][]byte{
+				serverFrame(false, wsText, []byte("hel")),
+				serverFrame(true, wsPing, []byte("ping")),
+				serverFrame(true, wsContinuation, []byte("lo")),
+			},
+			want:  []byte("hello"),
+			pongs: 1,
+		},
+		{
+			name:   "close",
+			frames: [][]byte{serverFrame(true, wsClose, []byte{0x03, 0xE8})},
+			err:    errWebSocketClosed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			ws := &wsConn{conn: client, reader: bufio.NewReader(client)}
+			written := make(chan []byte, 1)
+
+			go func() {
+				replies := []byte{}
+				reader := bufio.NewReader(server)
+
+				for _, frame := range test.frames {
+					server.Write(frame)
+
+					if frame[0]&0x0F == wsPing || frame[0]&0x0F == wsClose {
+						opcode, payload := readClientFrame(t, reader)
+						replies = append(replies, opcode)
+
+						if frame[0]&0x0F == wsPing && !bytes.Equal(payload, []byte("ping")) {
+							t.Errorf("pong payload = %q, want the ping's", payload)
+						}
+					}
+				}
+
+				written <- replies
+			}()
+
+			got, err := ws.ReadMessage()
+
+			if err != test.err {
+				t.Fatalf("ReadMessage error = %v, want %v", err, test.err)
+			}
+
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("ReadMessage = %q, want %q", truncate(got), truncate(test.want))
+			}
+
+			pongs := 0
+
+			for _, opcode := range <-written {
+				if opcode == wsPong {
+					pongs++
+				}
+			}
+
+			if pongs != test.pongs {
+				t.Errorf("sent %v pongs, want %v", pongs, test.pongs)
+			}
+		})
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ws := &wsConn{conn: client, reader: bufio.NewReader(client)}
+	header := []byte{0x80 | wsBinary, 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[2:], wsMaxMessage+1)
+
+	go server.Write(header)
+
+	if _, err := ws.ReadMessage(); err == nil {
+		t.Errorf("expected an error for a message over %v bytes", wsMaxMessage)
+	}
+}
+
+func truncate(b []byte) []byte {
+	if len(b) > 32 {
+		return b[:32]
+	}
+
+	return b
+}
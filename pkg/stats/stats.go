@@ -0,0 +1,131 @@
+package stats
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// MaxSamples is how many values a Distribution keeps for percentiles, once
+// reached new values replace old ones at random (reservoir sampling)
+const MaxSamples = 100000
+
+// Distribution summarises a stream of values, it is not safe for concurrent
+// use and is meant to be fed from a replicator's Run loop
+type Distribution struct {
+	count   int64
+	sum     int64
+	min     int64
+	max     int64
+	samples []int64
+	sorted  bool
+}
+
+func (d *Distribution) Add(value int64) {
+	if d.count == 0 || value < d.min {
+		d.min = value
+	}
+
+	if d.count == 0 || value > d.max {
+		d.max = value
+	}
+
+	d.count++
+	d.sum += value
+
+	if len(d.samples) < MaxSamples {
+		d.samples = append(d.samples, value)
+	} else if i := rand.Int63n(d.count); i < MaxSamples {
+		d.samples[i] = value
+	}
+
+	d.sorted = false
+}
+
+func (d *Distribution) Count() int64 {
+	return d.count
+}
+
+func (d *Distribution) Sum() int64 {
+	return d.sum
+}
+
+func (d *Distribution) Min() int64 {
+	return d.min
+}
+
+func (d *Distribution) Max() int64 {
+	return d.max
+}
+
+func (d *Distribution) Mean() int64 {
+	if d.count == 0 {
+		return 0
+	}
+
+	return d.sum / d.count
+}
+
+// Percentile returns the value below which p (0-100) percent of values fall
+func (d *Distribution) Percentile(p float64) int64 {
+	if len(d.samples) == 0 {
+		return 0
+	}
+
+	if !d.sorted {
+		sort.Slice(d.samples, func(i, j int) bool { return d.samples[i] < d.samples[j] })
+		d.sorted = true
+	}
+
+	index := int(p / 100 * float64(len(d.samples)))
+
+	if index >= len(d.samples) {
+		index = len(d.samples) - 1
+	}
+
+	if index < 0 {
+		index = 0
+	}
+
+	return d.samples[index]
+}
+
+func (d *Distribution) String() string {
+	return fmt.Sprintf("avg %v, min %v, p50 %v, p90 %v, p99 %v, max %v",
+		d.Mean(), d.Min(), d.Percentile(50), d.Percentile(90), d.Percentile(99), d.Max())
+}
+
+// Latency is a Distribution of durations
+type Latency struct {
+	Distribution
+}
+
+func (l *Latency) Add(duration time.Duration) {
+	l.Distribution.Add(int64(duration))
+}
+
+func (l *Latency) Total() time.Duration {
+	return time.Duration(l.Sum())
+}
+
+func (l *Latency) Min() time.Duration {
+	return time.Duration(l.Distribution.Min())
+}
+
+func (l *Latency) Max() time.Duration {
+	return time.Duration(l.Distribution.Max())
+}
+
+func (l *Latency) Mean() time.Duration {
+	return time.Duration(l.Distribution.Mean())
+}
+
+func (l *Latency) Percentile(p float64) time.Duration {
+	return time.Duration(l.Distribution.Percentile(p))
+}
+
+func (l *Latency) String() string {
+	return fmt.Sprintf("avg %v, min %v, p50 %v, p90 %v, p99 %v, max %v",
+		l.Mean(), l.Min(), l.Percentile(50), l.Percentile(90), l.Percentile(99), l.Max())
+}
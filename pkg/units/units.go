@@ -0,0 +1,61 @@
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a size in bytes with an optional b,k,m,g,t,p or e suffix,
+// every suffix past b is a power of 1024
+func ParseSize(memString string) (int64, error) {
+	if len(memString) == 0 {
+		return 0, fmt.Errorf("String was empty")
+	}
+
+	lowerMemString := strings.ToLower(memString)
+
+	mem := int64(0)
+	scale := 0
+	numIndex := 0
+
+	for i := len(lowerMemString) - 1; i >= 0; i-- {
+		char := lowerMemString[i]
+		switch char {
+		case 'e':
+			// scale = exabyte
+			scale = 60
+		case 'p':
+			// scale = petabye
+			scale = 50
+		case 't':
+			// scale = terabyte
+			scale = 40
+		case 'g':
+			// scale = gigabyte
+			scale = 30
+		case 'm':
+			// scale = megabyte
+			scale = 20
+		case 'k':
+			// scale = kilobyte
+			scale = 10
+		case 'b':
+			scale = 0
+		default:
+			num, err := strconv.ParseInt(string(memString[i]), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("unable to parse %v as an integer %v", string(char), err)
+			}
+			mem += num * int64(math.Pow10(numIndex))
+			numIndex = numIndex + 1
+		}
+	}
+
+	if scale > 0 {
+		mem *= int64(math.Pow(2, float64(scale)))
+	}
+
+	return mem, nil
+}
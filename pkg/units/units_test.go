@@ -0,0 +1,37 @@
+package units
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512b", 512, false},
+		{"4k", 4 << 10, false},
+		{"4K", 4 << 10, false},
+		{"10m", 10 << 20, false},
+		{"2g", 2 << 30, false},
+		{"1t", 1 << 40, false},
+		{"1p", 1 << 50, false},
+		{"", 0, true},
+		{"lots", 0, true},
+		{"4x", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSize(test.size)
+
+		if (err != nil) != test.err {
+			t.Errorf("ParseSize(%q) error = %v, want error %v", test.size, err, test.err)
+			continue
+		}
+
+		if !test.err && got != test.want {
+			t.Errorf("ParseSize(%q) = %v, want %v", test.size, got, test.want)
+		}
+	}
+}